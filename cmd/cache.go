@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/beringresearch/macpine/host"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// cacheCmd manages cached base images
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "List and clean cached base images.",
+}
+
+var cacheListCmd = &cobra.Command{
+	Use:     "list",
+	Short:   "List cached base images and the instances using them.",
+	Run:     cacheList,
+	Aliases: []string{"ls"},
+
+	DisableFlagsInUseLine: true,
+}
+
+var cacheCleanCmd = &cobra.Command{
+	Use:     "clean [<image>...]",
+	Short:   "Remove cached base images. Without arguments, removes every image no instance uses.",
+	Run:     cacheClean,
+	Aliases: []string{"prune", "rm"},
+
+	ValidArgsFunction:     autoCompleteCacheImages,
+	DisableFlagsInUseLine: true,
+}
+
+func init() {
+	cacheCmd.AddCommand(cacheListCmd)
+	cacheCmd.AddCommand(cacheCleanCmd)
+}
+
+func cacheList(cmd *cobra.Command, args []string) {
+	images, err := host.ListCacheImages()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tSIZE\tUSED BY\t")
+	for _, image := range images {
+		row := []string{
+			image.Name,
+			fmt.Sprintf("%dMB", image.Size/1000000),
+			strings.Join(image.Users, ","),
+		}
+		fmt.Fprintln(w, strings.Join(row, "    \t")+"    \t")
+	}
+	w.Flush()
+}
+
+func cacheClean(cmd *cobra.Command, args []string) {
+	images, err := host.ListCacheImages()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	names := make([]string, len(images))
+	for i, image := range images {
+		names[i] = image.Name
+	}
+
+	var errs []utils.CmdResult
+	for _, arg := range args {
+		if !utils.StringSliceContains(names, arg) {
+			errs = append(errs, utils.CmdResult{Name: arg, Err: errors.New("unknown cached image " + arg)})
+		}
+	}
+
+	for _, image := range images {
+		if len(args) == 0 {
+			if len(image.Users) > 0 {
+				continue
+			}
+		} else if !utils.StringSliceContains(args, image.Name) {
+			continue
+		}
+
+		err := host.RemoveCacheImage(image)
+		if err != nil {
+			errs = append(errs, utils.CmdResult{Name: image.Name, Err: err})
+			continue
+		}
+		log.Printf("removed %s\n", image.Name)
+	}
+
+	wasErr := false
+	for _, res := range errs {
+		if res.Err != nil {
+			log.Printf("failed to remove %s: %v\n", res.Name, res.Err)
+			wasErr = true
+		}
+	}
+	if wasErr {
+		log.Fatalln("error cleaning cache")
+	}
+}
+
+func autoCompleteCacheImages(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	images, err := host.ListCacheImages()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	names := make([]string, len(images))
+	for i, image := range images {
+		names[i] = image.Name
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/beringresearch/macpine/host"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// cloneCmd copies an Alpine instance
+var cloneCmd = &cobra.Command{
+	Use:   "clone <instance> <name>",
+	Short: "Create a new instance from an existing one.",
+	Long: "Create a new instance from an existing one.\n\n" +
+		"A linked clone moves the disk of the source instance to ~/.macpine/cache, where it becomes the read-only base image that " +
+		"both instances are copy-on-write overlays of. Use --full to leave the source instance as it is.",
+	Run:     clone,
+	Aliases: []string{"cp", "copy"},
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+var cloneFull bool
+var cloneSnapshot string
+
+func init() {
+	includeCloneFlags(cloneCmd)
+	includeWaitFlag(cloneCmd)
+}
+
+func includeCloneFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVarP(&cloneFull, "full", "f", false, "Copy the whole disk instead of creating a linked copy-on-write clone.")
+	cmd.Flags().StringVar(&cloneSnapshot, "snapshot", "", "Clone the disk as it was at this snapshot. Required for running instances. Implies --full.")
+}
+
+func clone(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		log.Fatalln("missing instance name")
+	}
+	if len(args) < 2 {
+		log.Fatalln("missing new name argument")
+	}
+
+	vmName := args[0]
+	vmList := host.ListVMNames()
+	exists := utils.StringSliceContains(vmList, vmName)
+	if !exists {
+		log.Fatalln("unknown instance " + vmName)
+	}
+
+	newName := args[1]
+	err := ValidateName(newName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if utils.StringSliceContains(vmList, newName) {
+		log.Fatal("instance with name \"" + newName + "\" already exists")
+	}
+
+	lock, err := qemu.LockInstance(vmName, "clone", waitForLock)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer lock.Unlock()
+
+	machineConfig, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = host.Clone(machineConfig, newName, cloneFull, cloneSnapshot)
+	if err != nil {
+		log.Fatalf("unable to clone %s: %v\n", vmName, err)
+	}
+}
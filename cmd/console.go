@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	run "os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/beringresearch/macpine/host"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// consoleCmd attaches to the serial console of an instance
+var consoleCmd = &cobra.Command{
+	Use:     "console <instance>",
+	Short:   "Attach to the serial console of an instance.",
+	Run:     console,
+	Aliases: []string{"serial", "attach"},
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+var detachKeys string
+var serveConsole bool
+
+func init() {
+	includeConsoleFlags(consoleCmd)
+}
+
+func includeConsoleFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&detachKeys, "detach-keys", "ctrl-]", "Comma separated key sequence to detach from the console, such as ctrl-p,ctrl-q.")
+	cmd.Flags().BoolVar(&serveConsole, "serve", false, "Run the console broker shared by attached clients.")
+	cmd.Flags().MarkHidden("serve")
+}
+
+func console(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+
+	vmName := args[0]
+	vmList := host.ListVMNames()
+	exists := utils.StringSliceContains(vmList, vmName)
+	if !exists {
+		log.Fatalln("unknown instance " + vmName)
+	}
+
+	machineConfig, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if serveConsole {
+		if err := machineConfig.ServeConsole(); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	detach, err := parseDetachKeys(detachKeys)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if status, _ := machineConfig.Status(); !status.Active() {
+		log.Fatalln(&qemu.StateError{Alias: vmName, Op: "attach to", State: status, Err: qemu.ErrNotRunning})
+	}
+
+	err = ensureConsoleBroker(machineConfig)
+	if err != nil {
+		log.Fatalln("unable to attach console: " + err.Error())
+	}
+
+	err = machineConfig.Console(detach, detachKeys)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// ensureConsoleBroker starts a detached console broker for the instance
+// unless one is already accepting clients
+func ensureConsoleBroker(machineConfig qemu.MachineConfig) error {
+	if conn, err := net.Dial("unix", machineConfig.ConsoleSocket()); err == nil {
+		conn.Close()
+		return nil
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	broker := run.Command(self, "console", "--serve", machineConfig.Alias)
+	broker.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := broker.Start(); err != nil {
+		return err
+	}
+	broker.Process.Release()
+
+	return utils.Retry(20, 250*time.Millisecond, func() error {
+		conn, err := net.Dial("unix", machineConfig.ConsoleSocket())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// parseDetachKeys converts a comma separated list of keys such as
+// "ctrl-p,ctrl-q" into the bytes the terminal sends for them
+func parseDetachKeys(keys string) ([]byte, error) {
+	var seq []byte
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.ToLower(strings.TrimSpace(key))
+		switch {
+		case len(key) == 1:
+			seq = append(seq, key[0])
+		case strings.HasPrefix(key, "ctrl-") && len(key) == 6:
+			c := key[5]
+			if c < '@' || c > '_' {
+				c -= 'a' - 'A'
+			}
+			if c < '@' || c > '_' {
+				return nil, errors.New("invalid detach key " + key)
+			}
+			seq = append(seq, c-'@')
+		default:
+			return nil, errors.New("invalid detach key " + key)
+		}
+	}
+	return seq, nil
+}
@@ -25,6 +25,10 @@ var editCmd = &cobra.Command{
 	DisableFlagsInUseLine: true,
 }
 
+func init() {
+	includeWaitFlag(editCmd)
+}
+
 func edit(cmd *cobra.Command, args []string) {
 
 	userHomeDir, err := os.UserHomeDir()
@@ -52,6 +56,18 @@ func edit(cmd *cobra.Command, args []string) {
 		}
 	}
 
+	// keep other operations from saving over the edited configurations
+	for i, vmName := range args {
+		if utils.StringSliceContains(args[:i], vmName) {
+			continue
+		}
+		lock, err := qemu.LockInstance(vmName, "edit", waitForLock)
+		if err != nil {
+			log.Fatalf("cannot edit %s: %v\n", vmName, err)
+		}
+		defer lock.Unlock()
+	}
+
 	targetFiles := make([]string, len(args))
 	for i, name := range args {
 		targetFiles[i] = filepath.Join(userHomeDir, ".macpine", name, "config.yaml")
@@ -139,6 +155,16 @@ func validateConfig(args []string) []utils.CmdResult {
 			errs[i] = utils.CmdResult{Name: vmName, Err: err}
 			continue
 		}
+		err = machineConfig.CheckNetworkSettings()
+		if err != nil {
+			errs[i] = utils.CmdResult{Name: vmName, Err: err}
+			continue
+		}
+		err = machineConfig.CheckProxySettings()
+		if err != nil {
+			errs[i] = utils.CmdResult{Name: vmName, Err: err}
+			continue
+		}
 		if loc, err := os.Stat(machineConfig.Location); os.IsNotExist(err) {
 			errs[i] = utils.CmdResult{Name: vmName, Err: errors.New("location directory does not exist")}
 			continue
@@ -1,19 +1,25 @@
 package cmd
 
 import (
+	"errors"
 	"log"
+	"os"
 	"strings"
 
 	"github.com/beringresearch/macpine/host"
 	"github.com/beringresearch/macpine/qemu"
 	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
 )
 
 // execCmd executes command on alpine vm
 var execCmd = &cobra.Command{
-	Use:     "exec <instance> <command>",
-	Short:   "execute a command on an instance over ssh.",
+	Use:   "exec <instance> <command>",
+	Short: "execute a command on an instance over ssh.",
+	Long: "Execute a command on an instance over ssh.\n\n" +
+		"Output is streamed as the command runs, standard input is forwarded to it, and alpine exits with the\n" +
+		"exit status of the command. The command runs once; only connecting to the instance is retried.",
 	Run:     exec,
 	Aliases: []string{"x", "execute", "cmd", "command"},
 
@@ -41,6 +47,11 @@ func exec(cmd *cobra.Command, args []string) {
 	}
 
 	err = host.Exec(machineConfig, cmdArgs)
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		// the command has reported its own failure on stderr
+		os.Exit(exitErr.ExitStatus())
+	}
 	if err != nil {
 		log.Fatalln(err)
 	}
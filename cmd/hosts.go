@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/beringresearch/macpine/host"
+	"github.com/spf13/cobra"
+)
+
+// hostsCmd manages the <alias>.macpine.local names of instances
+var hostsCmd = &cobra.Command{
+	Use:   "hosts",
+	Short: "List and install the <name>.macpine.local names of running instances.",
+}
+
+var hostsListCmd = &cobra.Command{
+	Use:     "list",
+	Short:   "List the names of running instances and their addresses.",
+	Run:     hostsList,
+	Aliases: []string{"ls"},
+
+	DisableFlagsInUseLine: true,
+}
+
+var hostsInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Add the names of running instances to /etc/hosts, which is then updated on start, stop and rename.",
+	Long: "Add the names of running instances to /etc/hosts, which is then updated on start, stop and rename.\n\n" +
+		"Updates fail while the file is not writable, so either run alpine as a user that may write it, or\n" +
+		"point a local resolver such as dnsmasq at ~/.macpine/hosts, which is always kept up to date.",
+	Run: hostsInstall,
+}
+
+var hostsUninstallCmd = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Remove the names of instances from /etc/hosts.",
+	Run:   hostsUninstall,
+}
+
+func init() {
+	hostsCmd.AddCommand(hostsListCmd)
+	hostsCmd.AddCommand(hostsInstallCmd)
+	hostsCmd.AddCommand(hostsUninstallCmd)
+}
+
+func hostsList(cmd *cobra.Command, args []string) {
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintln(w, "NAME\tADDRESS\t")
+	for _, entry := range host.HostsEntries(nil) {
+		row := []string{
+			entry.Name,
+			entry.IP,
+		}
+		fmt.Fprintln(w, strings.Join(row, "    \t")+"    \t")
+	}
+	w.Flush()
+}
+
+func hostsInstall(cmd *cobra.Command, args []string) {
+	if err := host.InstallHosts(); err != nil {
+		log.Fatalf("unable to install names in %s: %v\n", host.SystemHostsFile, err)
+	}
+	log.Printf("installed names in %s\n", host.SystemHostsFile)
+}
+
+func hostsUninstall(cmd *cobra.Command, args []string) {
+	if err := host.UninstallHosts(); err != nil {
+		log.Fatalf("unable to remove names from %s: %v\n", host.SystemHostsFile, err)
+	}
+	log.Printf("removed names from %s\n", host.SystemHostsFile)
+}
@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"filippo.io/age"
+	"github.com/beringresearch/macpine/host"
 	"github.com/beringresearch/macpine/qemu"
 	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
@@ -129,12 +130,22 @@ func importMachine(cmd *cobra.Command, args []string) {
 		log.Fatal("unable to import: " + err.Error())
 	}
 
+	// the imported guest is a new host, whatever key it was published with
+	err = machineConfig.ResetHostKey()
+	if err != nil {
+		os.RemoveAll(targetDir)
+		os.RemoveAll(tempArchive)
+		log.Fatal("unable to import: " + err.Error())
+	}
+
 	err = machineConfig.DecompressQemuDiskImage()
 	if err != nil {
 		os.RemoveAll(targetDir)
 		os.RemoveAll(tempArchive)
 		log.Fatal("unable to import: " + err.Error())
 	}
+
+	host.UpdateSSHConfig()
 }
 
 func decryptArchive(archive string) error {
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/beringresearch/macpine/host"
@@ -27,7 +28,11 @@ var launchCmd = &cobra.Command{
 }
 
 var machineArch, imageVersion, machineCPU, machineMemory, machineDisk, machinePort, sshPort, machineName, machineMount string
-var vmnet bool
+var machineBridge, machineTap, machineLeases string
+var vmnet, thin, machineHosts, sshKey, noPasswordAuth bool
+var machineNetworks, machineDNS, machineSearch []string
+var slirpNet, slirpDNS, slirpDHCPStart string
+var httpProxy, httpsProxy, noProxy, caBundle string
 
 func init() {
 	includeLaunchFlags(launchCmd)
@@ -40,10 +45,27 @@ func includeLaunchFlags(cmd *cobra.Command) {
 	cmd.Flags().StringVarP(&machineMemory, "memory", "m", "2048", "Amount of memory (in MB) to allocate.")
 	cmd.Flags().StringVarP(&machineDisk, "disk", "d", "5G", "Disk space (in bytes) to allocate. K, M, G suffixes are supported.")
 	cmd.Flags().StringVar(&machineMount, "mount", "", "Path to a host directory to be shared with the instance.")
-	cmd.Flags().StringVarP(&sshPort, "ssh", "s", "22", "Host port to forward for SSH (required).")
-	cmd.Flags().StringVarP(&machinePort, "port", "p", "", "Forward additional host ports. Multiple ports can be separated by `,`.")
+	cmd.Flags().StringVarP(&sshPort, "ssh", "s", "auto", "Host port to forward for SSH, or auto to pick a free one from MACPINE_PORT_RANGE.")
+	cmd.Flags().StringVarP(&machinePort, "port", "p", "", "Forward additional host ports, such as 8080:80, 127.0.0.1:8000-8010 or auto:80. Multiple ports can be separated by `,`.")
 	cmd.Flags().StringVarP(&machineName, "name", "n", "", "Instance name for use in `alpine` commands.")
 	cmd.Flags().BoolVarP(&vmnet, "shared", "v", false, "Toggle whether to use mac's native vmnet-shared mode.")
+	cmd.Flags().StringVar(&machineBridge, "bridge", "", "Attach the instance to a Linux bridge through qemu-bridge-helper.")
+	cmd.Flags().StringVar(&machineTap, "tap", "", "Attach the instance to an existing Linux tap device.")
+	cmd.Flags().StringVar(&machineLeases, "leases", "", "DHCP lease file used to find the address of the instance on a bridge or tap device. Defaults to the dnsmasq lease file.")
+	cmd.Flags().StringSliceVar(&machineNetworks, "network", nil, "Attach the instance to a network created with `alpine network create`, optionally with a static address as name=10.10.0.2. Can be repeated.")
+	cmd.Flags().BoolVar(&machineHosts, "hosts", false, "Keep the <name>.macpine.local names of running instances in /etc/hosts of the instance.")
+	cmd.Flags().StringSliceVar(&machineDNS, "dns", nil, "DNS servers of the instance. Defaults to the resolvers of the host.")
+	cmd.Flags().StringSliceVar(&machineSearch, "search", nil, "DNS search domains of the instance. Defaults to those of the host.")
+	cmd.Flags().StringVar(&slirpNet, "slirp-net", "", "Guest network of the default user network, such as 10.0.2.0/24.")
+	cmd.Flags().StringVar(&slirpDNS, "slirp-dns", "", "Address of the DNS forwarder of the default user network. Defaults to the third address of --slirp-net.")
+	cmd.Flags().StringVar(&slirpDHCPStart, "slirp-dhcpstart", "", "First address handed out by the DHCP server of the default user network.")
+	cmd.Flags().StringVar(&httpProxy, "http-proxy", "", "Proxy of the instance for http. Defaults to http_proxy of the host.")
+	cmd.Flags().StringVar(&httpsProxy, "https-proxy", "", "Proxy of the instance for https. Defaults to https_proxy of the host.")
+	cmd.Flags().StringVar(&noProxy, "no-proxy", "", "Hosts the instance reaches without the proxy. Defaults to no_proxy of the host.")
+	cmd.Flags().StringVar(&caBundle, "ca-bundle", "", "PEM file of certificates for the instance to trust, such as those of a TLS-intercepting proxy.")
+	cmd.Flags().BoolVar(&sshKey, "ssh-key", true, "Generate a keypair for the instance and log in with it, replacing the default root password with one kept in root.password.")
+	cmd.Flags().BoolVar(&noPasswordAuth, "no-password-auth", false, "Turn off password authentication in sshd of the instance. Requires --ssh-key.")
+	cmd.Flags().BoolVar(&thin, "thin", false, "Create the disk as a copy-on-write overlay of the cached image instead of a full copy.")
 }
 
 func CorrectArguments(imageVersion string, machineArch string, machineCPU string,
@@ -89,8 +111,8 @@ func CorrectArguments(imageVersion string, machineArch string, machineCPU string
 	}
 
 	int, err = strconv.Atoi(sshPort)
-	if err != nil || int < 0 {
-		return errors.New("ssh port (-s) must be a positive integer")
+	if sshPort != "auto" && (err != nil || int < 0) {
+		return errors.New("ssh port (-s) must be a positive integer or auto")
 	}
 
 	_, err = utils.ParsePort(machinePort)
@@ -116,6 +138,13 @@ func launch(cmd *cobra.Command, args []string) {
 		log.Fatalln(err.Error())
 	}
 
+	if err := checkHostNetwork(); err != nil {
+		log.Fatalln(err)
+	}
+	if noPasswordAuth && !sshKey {
+		log.Fatalln("--no-password-auth requires --ssh-key")
+	}
+
 	userHomeDir, err := os.UserHomeDir()
 	if err != nil {
 		log.Fatalln(err)
@@ -141,6 +170,8 @@ func launch(cmd *cobra.Command, args []string) {
 		for utils.StringSliceContains(vmList, machineName) { // if exists, re-randomize
 			machineName = utils.GenerateRandomAlias()
 		}
+	} else if err := ValidateName(machineName); err != nil {
+		log.Fatalln(err)
 	} else if utils.StringSliceContains(vmList, machineName) {
 		log.Fatal("instance with name \"" + machineName + "\" already exists")
 	}
@@ -150,28 +181,81 @@ func launch(cmd *cobra.Command, args []string) {
 		log.Fatal(err)
 	}
 
+	var nics []qemu.NIC
+	for _, n := range machineNetworks {
+		name, ip, _ := strings.Cut(n, "=")
+		for _, nic := range nics {
+			if nic.Network == name {
+				log.Fatal("network " + name + " given more than once")
+			}
+		}
+		nic, err := qemu.NewNIC(name, ip)
+		if err != nil {
+			log.Fatal(err)
+		}
+		nics = append(nics, nic)
+	}
+
+	hostHTTPProxy, hostHTTPSProxy, hostNoProxy := qemu.HostProxy()
+	if !cmd.Flags().Changed("http-proxy") {
+		httpProxy = hostHTTPProxy
+	}
+	if !cmd.Flags().Changed("https-proxy") {
+		httpsProxy = hostHTTPSProxy
+	}
+	if !cmd.Flags().Changed("no-proxy") {
+		noProxy = hostNoProxy
+	}
+	if caBundle != "" {
+		caBundle, err = filepath.Abs(caBundle)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	machineIP := "localhost"
 
 	machineConfig := qemu.MachineConfig{
-		Alias:       machineName,
-		Image:       imageVersion + "-" + machineArch + ".qcow2",
-		Arch:        machineArch,
-		CPU:         machineCPU,
-		Memory:      machineMemory,
-		Disk:        machineDisk,
-		Mount:       machineMount,
-		MachineIP:   machineIP,
-		Port:        machinePort,
-		SSHPort:     sshPort,
-		MACAddress:  macAddress,
-		VMNet:       vmnet,
-		SSHUser:     "root",
-		SSHPassword: "raw::root",
-		Tags:        []string{},
+		Alias:          machineName,
+		Image:          imageVersion + "-" + machineArch + ".qcow2",
+		Arch:           machineArch,
+		CPU:            machineCPU,
+		Memory:         machineMemory,
+		Disk:           machineDisk,
+		Mount:          machineMount,
+		MachineIP:      machineIP,
+		Port:           machinePort,
+		SSHPort:        sshPort,
+		MACAddress:     macAddress,
+		NICs:           nics,
+		VMNet:          vmnet,
+		Bridge:         machineBridge,
+		Tap:            machineTap,
+		Leases:         machineLeases,
+		Hosts:          machineHosts,
+		DNS:            machineDNS,
+		Search:         machineSearch,
+		SlirpNet:       slirpNet,
+		SlirpDNS:       slirpDNS,
+		SlirpDHCPStart: slirpDHCPStart,
+		HTTPProxy:      httpProxy,
+		HTTPSProxy:     httpsProxy,
+		NoProxy:        noProxy,
+		CABundle:       caBundle,
+		SSHUser:        "root",
+		SSHPassword:    "raw::root",
+		Tags:           []string{},
 	}
 	machineConfig.Location = filepath.Join(userHomeDir, ".macpine", machineConfig.Alias)
 
-	err = host.Launch(machineConfig)
+	if err := machineConfig.CheckNetworkSettings(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := machineConfig.CheckProxySettings(); err != nil {
+		log.Fatalln(err)
+	}
+
+	err = host.Launch(machineConfig, thin, sshKey, noPasswordAuth)
 	if err != nil {
 		os.RemoveAll(machineConfig.Location)
 		pid, _ := machineConfig.GetInstancePID()
@@ -184,6 +268,27 @@ func launch(cmd *cobra.Command, args []string) {
 	log.Println("launched: " + machineName)
 }
 
+// checkHostNetwork returns an error unless at most one host network is given,
+// and bridges and tap devices are only used on Linux
+func checkHostNetwork() error {
+	modes := 0
+	for _, set := range []bool{vmnet, machineBridge != "", machineTap != ""} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return errors.New("--shared, --bridge and --tap are mutually exclusive")
+	}
+	if (machineBridge != "" || machineTap != "") && runtime.GOOS != "linux" {
+		return errors.New("--bridge and --tap are only available on Linux hosts")
+	}
+	if machineLeases != "" && modes == 0 {
+		return errors.New("--leases requires --shared, --bridge or --tap")
+	}
+	return nil
+}
+
 func flagsLaunch(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 	return nil, cobra.ShellCompDirectiveNoFileComp
 }
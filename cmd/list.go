@@ -37,8 +37,8 @@ func list(cmd *cobra.Command, args []string) {
 		configs = append(configs, machineConfig)
 
 		s, p := host.Status(machineConfig)
-		status = append(status, s)
-		if s == "Stopped" {
+		status = append(status, string(s))
+		if p == 0 {
 			pid = append(pid, "-")
 		} else {
 			pid = append(pid, fmt.Sprint(p))
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/beringresearch/macpine/host"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// logsCmd prints instance logs
+var logsCmd = &cobra.Command{
+	Use:   "logs <instance>",
+	Short: "Print the serial console or QEMU log of an instance.",
+	Long: "Print the serial console or QEMU log of an instance.\n\n" +
+		"The QEMU log holds what QEMU printed while starting, followed by its debug log of the current boot. " +
+		"The debug log has no timestamps, so --since prints it whole if it was written to since then.",
+	Run:     logs,
+	Aliases: []string{"log"},
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+var logsFollow, logsQEMU bool
+var logsTail int
+var logsSince string
+
+func init() {
+	includeLogsFlags(logsCmd)
+}
+
+func includeLogsFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVarP(&logsFollow, "follow", "f", false, "Keep printing output as it is written.")
+	cmd.Flags().IntVarP(&logsTail, "tail", "n", -1, "Number of lines to print from the end of the log. Defaults to all.")
+	cmd.Flags().StringVar(&logsSince, "since", "", "Only print output since a time, either relative (e.g. 10m, 2h) or RFC 3339.")
+	cmd.Flags().BoolVar(&logsQEMU, "qemu", false, "Print QEMU's own log instead of the serial console.")
+}
+
+func parseSince(since string) (time.Time, error) {
+	if d, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.New("--since must be a duration such as 10m or an RFC 3339 time")
+}
+
+func logs(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+
+	vmName := args[0]
+	vmList := host.ListVMNames()
+	exists := utils.StringSliceContains(vmList, vmName)
+	if !exists {
+		log.Fatalln("unknown instance " + vmName)
+	}
+
+	machineConfig, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// a running instance has its logs rotated only when they are looked at
+	if status, _ := machineConfig.Status(); status.Active() {
+		if err := machineConfig.RotateRunningLogs(); err != nil {
+			log.Println("unable to rotate logs of " + vmName + ": " + err.Error())
+		}
+	}
+
+	var since time.Time
+	if logsSince != "" {
+		since, err = parseSince(logsSince)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	path := machineConfig.SerialLog()
+	if logsQEMU {
+		path = machineConfig.DebugLog()
+	}
+
+	lines, size, err := utils.ReadLines(path)
+	noLogs := errors.Is(err, os.ErrNotExist)
+	if noLogs {
+		lines, size = nil, 0
+	} else if err != nil {
+		log.Fatalln(err)
+	}
+
+	if logsQEMU {
+		// the debug log holds no timestamps, and is printed whole if it was
+		// written to since then
+		if info, err := os.Stat(path); err == nil && info.ModTime().Before(since) {
+			lines = nil
+		}
+		// qemu's output up to daemonizing comes before its debug log
+		startup, _, err := utils.ReadLines(machineConfig.QEMULog())
+		if err == nil {
+			noLogs = false
+		} else if !errors.Is(err, os.ErrNotExist) {
+			log.Fatalln(err)
+		}
+		if logsSince != "" {
+			startup = qemu.LinesSince(startup, since, false)
+		}
+		lines = append(startup, lines...)
+	} else if logsSince != "" {
+		lines = qemu.LinesSince(lines, since, true)
+	}
+
+	if noLogs && !logsFollow {
+		log.Fatalf("%s has no logs yet\n", vmName)
+	}
+
+	if logsTail >= 0 && logsTail < len(lines) {
+		lines = lines[len(lines)-logsTail:]
+	}
+	fmt.Print(strings.Join(lines, ""))
+
+	if !logsFollow {
+		return
+	}
+
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	stop := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		close(stop)
+	}()
+
+	err = utils.FollowFile(path, size, os.Stdout, stop)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,226 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/beringresearch/macpine/host"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// networkCmd manages private networks between instances
+var networkCmd = &cobra.Command{
+	Use:     "network",
+	Short:   "Create, list, and remove private networks between instances.",
+	Aliases: []string{"net"},
+}
+
+var networkCreateCmd = &cobra.Command{
+	Use:   "create <network>",
+	Short: "Create a private network. Attached instances can reach each other directly.",
+	Run:   networkCreate,
+}
+
+var networkListCmd = &cobra.Command{
+	Use:     "list",
+	Short:   "List networks and the instances attached to them.",
+	Run:     networkList,
+	Aliases: []string{"ls"},
+
+	DisableFlagsInUseLine: true,
+}
+
+var networkRemoveCmd = &cobra.Command{
+	Use:     "remove <network> [<network>...]",
+	Short:   "Remove networks that no instance is attached to.",
+	Run:     networkRemove,
+	Aliases: []string{"rm", "del", "delete"},
+
+	ValidArgsFunction:     autoCompleteNetworks,
+	DisableFlagsInUseLine: true,
+}
+
+var networkAttachCmd = &cobra.Command{
+	Use:   "attach <network> <instance>",
+	Short: "Add an interface on a network to a stopped instance.",
+	Run:   networkAttach,
+
+	ValidArgsFunction: autoCompleteNetworkAndInstance,
+}
+
+var networkDetachCmd = &cobra.Command{
+	Use:   "detach <network> <instance>",
+	Short: "Remove the interface on a network from a stopped instance.",
+	Run:   networkDetach,
+
+	ValidArgsFunction: autoCompleteNetworkAndInstance,
+}
+
+// networkServeCmd runs the switch of a network. It is started in the
+// background by start and launch.
+var networkServeCmd = &cobra.Command{
+	Use:    "serve <network>",
+	Args:   cobra.ExactArgs(1),
+	Run:    networkServe,
+	Hidden: true,
+}
+
+var networkSubnet, networkIP string
+
+func init() {
+	networkCreateCmd.Flags().StringVar(&networkSubnet, "subnet", "", "Subnet of the network in CIDR notation, such as 10.10.0.0/24. Static addresses must fall within it.")
+	networkAttachCmd.Flags().StringVar(&networkIP, "ip", "", "Static address of the instance on the network, such as 10.10.0.2 or 10.10.0.2/24.")
+	includeWaitFlag(networkAttachCmd)
+	includeWaitFlag(networkDetachCmd)
+
+	networkCmd.AddCommand(networkCreateCmd)
+	networkCmd.AddCommand(networkListCmd)
+	networkCmd.AddCommand(networkRemoveCmd)
+	networkCmd.AddCommand(networkAttachCmd)
+	networkCmd.AddCommand(networkDetachCmd)
+	networkCmd.AddCommand(networkServeCmd)
+}
+
+func validateNetworkName(name string) error {
+	format := regexp.MustCompile(`^[a-zA-Z0-9_\-\.]+$`)
+	if !format.MatchString(name) || strings.HasPrefix(name, ".") {
+		return errors.New("invalid network name, accepted characters are [A-Za-z0-9], '.', '_', and '-'")
+	}
+	return nil
+}
+
+func networkCreate(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatal("specify a single network name")
+	}
+	if err := validateNetworkName(args[0]); err != nil {
+		log.Fatalln(err)
+	}
+
+	err := qemu.CreateNetwork(qemu.Network{Name: args[0], Subnet: networkSubnet})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("created %s\n", args[0])
+}
+
+func networkList(cmd *cobra.Command, args []string) {
+	networks, err := host.ListNetworks()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSUBNET\tINSTANCES\t")
+	for _, network := range networks {
+		row := []string{
+			network.Name,
+			network.Subnet,
+			strings.Join(network.Users, ","),
+		}
+		fmt.Fprintln(w, strings.Join(row, "    \t")+"    \t")
+	}
+	w.Flush()
+}
+
+func networkRemove(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing network name")
+	}
+
+	var errs []utils.CmdResult
+	for _, name := range args {
+		if err := host.RemoveNetwork(name); err != nil {
+			errs = append(errs, utils.CmdResult{Name: name, Err: err})
+			continue
+		}
+		log.Printf("removed %s\n", name)
+	}
+
+	wasErr := false
+	for _, res := range errs {
+		if res.Err != nil {
+			log.Printf("failed to remove %s: %v\n", res.Name, res.Err)
+			wasErr = true
+		}
+	}
+	if wasErr {
+		log.Fatalln("error removing network(s)")
+	}
+}
+
+// networkArgs returns the network and the instance
+func networkArgs(args []string) (string, string) {
+	if len(args) != 2 {
+		log.Fatal("specify a network and an instance")
+	}
+
+	vmName := args[1]
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+	return args[0], vmName
+}
+
+func networkAttach(cmd *cobra.Command, args []string) {
+	network, vmName := networkArgs(args)
+	err := withInstance(vmName, "network attach", func(machineConfig qemu.MachineConfig) error {
+		return host.AttachNetwork(machineConfig, network, networkIP)
+	})
+	if err != nil {
+		log.Fatalf("unable to attach %s to %s: %v\n", vmName, network, err)
+	}
+}
+
+func networkDetach(cmd *cobra.Command, args []string) {
+	network, vmName := networkArgs(args)
+	err := withInstance(vmName, "network detach", func(machineConfig qemu.MachineConfig) error {
+		return host.DetachNetwork(machineConfig, network)
+	})
+	if err != nil {
+		log.Fatalf("unable to detach %s from %s: %v\n", vmName, network, err)
+	}
+}
+
+func networkServe(cmd *cobra.Command, args []string) {
+	network, err := qemu.GetNetwork(args[0])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := network.ServeSwitch(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func networkNames() []string {
+	var names []string
+	networks, err := qemu.ListNetworks()
+	if err != nil {
+		return names
+	}
+	for _, network := range networks {
+		names = append(names, network.Name)
+	}
+	return names
+}
+
+func autoCompleteNetworks(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return networkNames(), cobra.ShellCompDirectiveNoFileComp
+}
+
+func autoCompleteNetworkAndInstance(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	switch len(args) {
+	case 0:
+		return networkNames(), cobra.ShellCompDirectiveNoFileComp
+	case 1:
+		return host.ListVMNames(), cobra.ShellCompDirectiveNoFileComp
+	}
+	return nil, cobra.ShellCompDirectiveNoFileComp
+}
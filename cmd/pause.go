@@ -1,12 +1,8 @@
 package cmd
 
 import (
-	"errors"
-	"log"
-
 	"github.com/beringresearch/macpine/host"
 	"github.com/beringresearch/macpine/qemu"
-	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
 )
 
@@ -20,49 +16,12 @@ var pauseCmd = &cobra.Command{
 	DisableFlagsInUseLine: true,
 }
 
-func pause(cmd *cobra.Command, args []string) {
-
-	if len(args) == 0 {
-		log.Fatal("missing instance name")
-	}
-
-	args, err := host.ExpandTagArguments(args)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	vmList := host.ListVMNames()
-	errs := make([]utils.CmdResult, len(args))
-	for i, vmName := range args {
-		if utils.StringSliceContains(args[:i], vmName) {
-			continue
-		}
-		exists := utils.StringSliceContains(vmList, vmName)
-		if !exists {
-			errs[i] = utils.CmdResult{Name: vmName, Err: errors.New("unknown instance " + vmName)}
-			continue
-		}
-
-		machineConfig, err := qemu.GetMachineConfig(vmName)
-		if err != nil {
-			errs[i] = utils.CmdResult{Name: vmName, Err: err}
-			continue
-		}
+func init() {
+	includeWaitFlag(pauseCmd)
+}
 
-		err = host.Pause(machineConfig)
-		if err != nil {
-			errs[i] = utils.CmdResult{Name: vmName, Err: err}
-			continue
-		}
-	}
-	wasErr := false
-	for _, res := range errs {
-		if res.Err != nil {
-			log.Printf("failed: %v\n", res.Err)
-			wasErr = true
-		}
-	}
-	if wasErr {
-		log.Fatalln("error pausing instance(s)")
-	}
+func pause(cmd *cobra.Command, args []string) {
+	forEachInstance(args, "pause", "error pausing instance(s)", func(machineConfig qemu.MachineConfig) error {
+		return host.Pause(machineConfig)
+	})
 }
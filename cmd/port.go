@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/beringresearch/macpine/host"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// portCmd manages port forwards of an instance
+var portCmd = &cobra.Command{
+	Use:     "port",
+	Short:   "Add, remove, and list port forwards of instances.",
+	Aliases: []string{"ports"},
+}
+
+var portAddCmd = &cobra.Command{
+	Use:   "add <instance> <port>[,<port>...]",
+	Short: "Forward host ports to an instance. Applied immediately if the instance is running.",
+	Long: "Forward host ports to an instance. Applied immediately if the instance is running.\n\n" +
+		"Ports use the syntax of the port setting in config.yaml: 8080 forwards host port 8080 to guest port 8080,\n" +
+		"8080:80 forwards host port 8080 to guest port 80, and a trailing u forwards UDP instead of TCP.",
+	Run: portAdd,
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+var portRemoveCmd = &cobra.Command{
+	Use:     "remove <instance> <port>[,<port>...]",
+	Short:   "Stop forwarding host ports to an instance. Applied immediately if the instance is running.",
+	Run:     portRemove,
+	Aliases: []string{"rm", "del", "delete"},
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+var portListCmd = &cobra.Command{
+	Use:     "list <instance> [<instance>...]",
+	Short:   "List port forwards of instances.",
+	Run:     portList,
+	Aliases: []string{"ls"},
+
+	ValidArgsFunction:     host.AutoCompleteVMNamesOrTags,
+	DisableFlagsInUseLine: true,
+}
+
+func init() {
+	includeWaitFlag(portAddCmd)
+	includeWaitFlag(portRemoveCmd)
+
+	portCmd.AddCommand(portAddCmd)
+	portCmd.AddCommand(portRemoveCmd)
+	portCmd.AddCommand(portListCmd)
+}
+
+// portArgs returns the instance and the ports, joined into a config.yaml port string
+func portArgs(args []string) (string, string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	if len(args) < 2 {
+		log.Fatal("missing port")
+	}
+
+	vmName := args[0]
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+	return vmName, strings.Join(args[1:], ",")
+}
+
+func portAdd(cmd *cobra.Command, args []string) {
+	vmName, ports := portArgs(args)
+	err := withInstance(vmName, "port add", func(machineConfig qemu.MachineConfig) error {
+		return host.AddPorts(machineConfig, ports)
+	})
+	if err != nil {
+		log.Fatalf("unable to forward ports to %s: %v\n", vmName, err)
+	}
+}
+
+func portRemove(cmd *cobra.Command, args []string) {
+	vmName, ports := portArgs(args)
+	err := withInstance(vmName, "port remove", func(machineConfig qemu.MachineConfig) error {
+		return host.RemovePorts(machineConfig, ports)
+	})
+	if err != nil {
+		log.Fatalf("unable to remove ports from %s: %v\n", vmName, err)
+	}
+}
+
+func portList(cmd *cobra.Command, args []string) {
+	configs := []qemu.MachineConfig{}
+	forEachInstance(args, "", "error listing port(s)", func(machineConfig qemu.MachineConfig) error {
+		configs = append(configs, machineConfig)
+		return nil
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tADDRESS\tHOST\tGUEST\tPROTO\t")
+	for _, machine := range configs {
+		ports, err := utils.ParsePort(machine.Port)
+		if err != nil {
+			log.Fatalf("invalid ports of %s: %v\n", machine.Alias, err)
+		}
+		for _, p := range ports {
+			address := p.Address
+			if address == "" {
+				address = "*"
+			}
+			row := []string{
+				machine.Alias,
+				address,
+				p.HostPorts(),
+				p.GuestPorts(),
+				p.Proto.String(),
+			}
+			fmt.Fprintln(w, strings.Join(row, "    \t")+"    \t")
+		}
+	}
+	w.Flush()
+}
@@ -29,6 +29,7 @@ var encrypt bool
 
 func init() {
 	includePublishFlags(publishCmd)
+	includeWaitFlag(publishCmd)
 }
 
 func includePublishFlags(cmd *cobra.Command) {
@@ -36,130 +37,81 @@ func includePublishFlags(cmd *cobra.Command) {
 }
 
 func publish(cmd *cobra.Command, args []string) {
+	forEachInstance(args, "publish", "error publishing instance(s)", publishInstance)
+}
 
-	if len(args) == 0 {
-		log.Fatal("missing instance name")
-	}
-
-	args, err := host.ExpandTagArguments(args)
+// publishInstance archives an instance to <instance>.tar.gz in the working directory
+func publishInstance(machineConfig qemu.MachineConfig) error {
+	// paused and saved instances may hold data that never reached the disk
+	vmStatus, _, err := machineConfig.RequireState("publish", qemu.StateStopped, qemu.StateCrashed, qemu.StateRunning)
 	if err != nil {
-		log.Fatal("unable to publish: " + err.Error())
+		return err
 	}
 
-	vmList := host.ListVMNames()
-	errs := make([]utils.CmdResult, len(args))
-	for i, vmName := range args {
-		if utils.StringSliceContains(args[:i], vmName) {
-			continue
-		}
-		exists := utils.StringSliceContains(vmList, vmName)
-		if !exists {
-			errs[i] = utils.CmdResult{Name: vmName, Err: errors.New("unknown instance " + vmName)}
-			continue
-		}
-
-		machineConfig, err := qemu.GetMachineConfig(vmName)
+	if vmStatus == qemu.StateRunning {
+		err = host.Stop(machineConfig)
 		if err != nil {
-			errs[i] = utils.CmdResult{Name: vmName, Err: err}
-			continue
+			return errors.New("error pausing instance before publish, stop instance and retry")
 		}
+		time.Sleep(time.Second)
+	}
 
-		vmStatus, _ := host.Status(machineConfig)
-		if vmStatus == "Paused" {
-			errs[i] = utils.CmdResult{
-				Name: vmName, Err: errors.New("error publishing paused instance due to possible data loss. start instance, sync data to disc and try again")}
-			continue
-		}
+	fileInfo, err := os.ReadDir(machineConfig.Location)
+	if err != nil {
+		return err
+	}
 
-		if vmStatus == "Running" {
-			_, err = machineConfig.Exec("sync", true)
-			if err != nil {
-				errs[i] = utils.CmdResult{
-					Name: vmName, Err: errors.New("error synchonizing filesystem before publish, stop instance and retry")}
-				continue
-			}
-			err = host.Stop(machineConfig)
-			if err != nil {
-				errs[i] = utils.CmdResult{
-					Name: vmName, Err: errors.New("error pausing instance before publish, stop instance and retry")}
-				continue
-			}
-			time.Sleep(time.Second)
-		}
+	// the disk is compressed into a copy, so that the instance keeps its
+	// snapshots and backing image
+	staging, err := os.MkdirTemp("", "macpine-publish-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
 
-		fileInfo, err := os.ReadDir(machineConfig.Location)
-		if err != nil {
-			errs[i] = utils.CmdResult{Name: vmName, Err: err}
-			continue
-		}
+	files, err := machineConfig.CompressQemuDiskImage(staging)
+	if err != nil {
+		return err
+	}
 
-		err = machineConfig.CompressQemuDiskImage()
-		if err != nil {
-			errs[i] = utils.CmdResult{Name: vmName, Err: err}
-			continue
+	for _, f := range fileInfo {
+		if !utils.StringSliceContains([]string{machineConfig.Image, "config.yaml", "alpine.qmp", "alpine.qga", "alpine.sock", "alpine.pid", "alpine.console", "alpine.console.lock", "alpine.lock", "alpine.ip", "known_hosts"}, f.Name()) {
+			files = append(files, filepath.Join(machineConfig.Location, f.Name()))
 		}
+	}
 
-		files := []string{}
-		for _, f := range fileInfo {
-			if !utils.StringSliceContains([]string{"alpine.qmp", "alpine.sock", "alpine.pid"}, f.Name()) {
-				files = append(files, filepath.Join(machineConfig.Location, f.Name()))
-			}
-		}
+	out, err := os.Create(machineConfig.Alias + ".tar.gz")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
 
-		out, err := os.Create(machineConfig.Alias + ".tar.gz")
-		if err != nil {
-			errs[i] = utils.CmdResult{Name: vmName, Err: err}
-			continue
-		}
-		defer out.Close()
+	// Create the archive and write the output to the "out" Writer
+	ext := ""
+	if encrypt {
+		ext = ".age"
+	}
+	log.Printf("creating archive %s...\n", machineConfig.Alias+".tar.gz"+ext)
 
-		// Create the archive and write the output to the "out" Writer
-		ext := ""
-		if encrypt {
-			ext = ".age"
-		}
-		log.Printf("creating archive %s...\n", machineConfig.Alias+".tar.gz"+ext)
+	err = utils.Compress(files, out)
+	if err != nil {
+		return err
+	}
 
-		err = utils.Compress(files, out)
+	if encrypt {
+		err = encryptArchive(&machineConfig)
 		if err != nil {
-			errs[i] = utils.CmdResult{Name: vmName, Err: err}
-			continue
-		}
-
-		if encrypt {
-			err = encryptArchive(&machineConfig)
-			if err != nil {
-				errs[i] = utils.CmdResult{Name: vmName, Err: err}
-				continue
-			}
-		}
-
-		if vmStatus == "Running" {
-			err = host.Start(machineConfig)
-			if err != nil {
-				errs[i] = utils.CmdResult{Name: vmName, Err: err}
-				continue
-			}
-		}
-
-		if vmStatus == "Paused" {
-			err = host.Pause(machineConfig)
-			if err != nil {
-				errs[i] = utils.CmdResult{Name: vmName, Err: err}
-				continue
-			}
+			return err
 		}
 	}
-	wasErr := false
-	for _, res := range errs {
-		if res.Err != nil {
-			log.Printf("unable to publish %s: %v\n", res.Name, res.Err)
-			wasErr = true
+
+	if vmStatus == qemu.StateRunning {
+		err = host.Start(machineConfig)
+		if err != nil {
+			return err
 		}
 	}
-	if wasErr {
-		log.Fatalln("error publishing instance(s)")
-	}
+	return nil
 }
 
 func encryptArchive(machineConfig *qemu.MachineConfig) error {
@@ -24,6 +24,10 @@ var renameCmd = &cobra.Command{
 	DisableFlagsInUseLine: true,
 }
 
+func init() {
+	includeWaitFlag(renameCmd)
+}
+
 func rename(cmd *cobra.Command, args []string) {
 
 	userHomeDir, err := os.UserHomeDir()
@@ -63,11 +67,22 @@ func rename(cmd *cobra.Command, args []string) {
 		}
 	}
 
+	lock, err := qemu.LockInstance(vmName, "rename", waitForLock)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer lock.Unlock()
+
 	machineConfig, err := qemu.GetMachineConfig(vmName)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	// a running qemu keeps the old paths and -name, and would look crashed
+	if _, _, err := machineConfig.RequireState("rename", qemu.StateStopped, qemu.StateSaved); err != nil {
+		log.Fatalln(err)
+	}
+
 	oldLocation := machineConfig.Location
 	newLocation := filepath.Join(configDir, newName)
 
@@ -83,20 +98,22 @@ func rename(cmd *cobra.Command, args []string) {
 	if err != nil {
 		log.Fatalf("error writing updated config: %v\n", err)
 	}
+	host.UpdateHosts()
+	host.UpdateSSHConfig()
 
 	log.Printf("renamed '%s' to '%s'\n", vmName, newName)
 }
 
 func ValidateName(name string) error {
-	if name == "cache" {
-		return errors.New("cannot rename: 'cache' is reserved")
+	if name == "cache" || name == "networks" || name == "hosts" || name == "ssh_config" {
+		return errors.New("invalid name: '" + name + "' is reserved")
 	}
 	if strings.HasPrefix(name, ".") {
-		return errors.New("cannot rename: name must not begin with '.'")
+		return errors.New("invalid name: name must not begin with '.'")
 	}
 	format := regexp.MustCompile(`^[a-zA-Z0-9_\-\.]+$`)
 	if !format.MatchString(name) {
-		return errors.New("cannot rename: invalid name, accepted characters are [A-Za-z0-9], '.', '_', and '-'")
+		return errors.New("invalid name: accepted characters are [A-Za-z0-9], '.', '_', and '-'")
 	}
 	return nil
 }
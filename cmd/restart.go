@@ -1,13 +1,11 @@
 package cmd
 
 import (
-	"errors"
 	"log"
 	"time"
 
 	"github.com/beringresearch/macpine/host"
 	"github.com/beringresearch/macpine/qemu"
-	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
 )
 
@@ -22,42 +20,16 @@ var restartCmd = &cobra.Command{
 	DisableFlagsInUseLine: true,
 }
 
-func restart(cmd *cobra.Command, args []string) {
-	if len(args) == 0 {
-		log.Fatal("missing instance name")
-	}
-
-	args, err := host.ExpandTagArguments(args)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	vmList := host.ListVMNames()
-	wasErr := false
-	for i, vmName := range args {
-		if utils.StringSliceContains(args[:i], vmName) {
-			continue
-		}
-		exists := utils.StringSliceContains(vmList, vmName)
-		if !exists {
-			wasErr = true
-			log.Println(errors.New("unknown instance " + vmName))
-			continue
-		}
-
-		machineConfig, err := qemu.GetMachineConfig(vmName)
-		if err != nil {
-			wasErr = true
-			log.Println(err)
-			continue
-		}
+func init() {
+	includeWaitFlag(restartCmd)
+}
 
-		log.Println("restarting " + vmName + "...")
-		err = host.Stop(machineConfig)
+func restart(cmd *cobra.Command, args []string) {
+	forEachInstance(args, "restart", "error restarting instance(s)", func(machineConfig qemu.MachineConfig) error {
+		log.Println("restarting " + machineConfig.Alias + "...")
+		err := host.Stop(machineConfig)
 		if err != nil {
-			wasErr = true
-			log.Println(err)
-			continue
+			return err
 		}
 
 		time.Sleep(time.Second)
@@ -65,12 +37,8 @@ func restart(cmd *cobra.Command, args []string) {
 		err = host.Start(machineConfig)
 		if err != nil {
 			host.Stop(machineConfig)
-			wasErr = true
-			log.Println(err)
-			continue
+			return err
 		}
-	}
-	if wasErr {
-		log.Fatalln("error restarting instance(s)")
-	}
+		return nil
+	})
 }
@@ -1,8 +1,13 @@
 package cmd
 
 import (
+	"errors"
+	"log"
 	"os"
 
+	"github.com/beringresearch/macpine/host"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
 )
 
@@ -33,6 +38,7 @@ func init() {
 	MacpineCmd.AddCommand(restartCmd)
 	MacpineCmd.AddCommand(pauseCmd)
 	MacpineCmd.AddCommand(resumeCmd)
+	MacpineCmd.AddCommand(suspendCmd)
 	MacpineCmd.AddCommand(deleteCmd)
 	MacpineCmd.AddCommand(listCmd)
 	MacpineCmd.AddCommand(publishCmd)
@@ -40,7 +46,84 @@ func init() {
 	MacpineCmd.AddCommand(execCmd)
 	MacpineCmd.AddCommand(editCmd)
 	MacpineCmd.AddCommand(renameCmd)
+	MacpineCmd.AddCommand(cloneCmd)
+	MacpineCmd.AddCommand(cacheCmd)
 	MacpineCmd.AddCommand(shellCmd)
+	MacpineCmd.AddCommand(consoleCmd)
+	MacpineCmd.AddCommand(logsCmd)
 	MacpineCmd.AddCommand(completionCmd)
 	MacpineCmd.AddCommand(tagCmd)
+	MacpineCmd.AddCommand(snapshotCmd)
+	MacpineCmd.AddCommand(portCmd)
+	MacpineCmd.AddCommand(networkCmd)
+	MacpineCmd.AddCommand(hostsCmd)
+	MacpineCmd.AddCommand(sshConfigCmd)
+}
+
+var waitForLock bool
+
+// includeWaitFlag adds --wait to commands that take instance locks
+func includeWaitFlag(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&waitForLock, "wait", false, "Wait for other operations on the instance(s) to finish instead of failing.")
+}
+
+// forEachInstance expands tags in args and applies f to every named instance,
+// exiting with failMsg if any of them fail. Unless op is empty, each instance
+// is locked for op while f runs.
+func forEachInstance(args []string, op string, failMsg string, f func(machineConfig qemu.MachineConfig) error) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+
+	args, err := host.ExpandTagArguments(args)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	vmList := host.ListVMNames()
+	errs := make([]utils.CmdResult, len(args))
+	for i, vmName := range args {
+		if utils.StringSliceContains(args[:i], vmName) {
+			continue
+		}
+		exists := utils.StringSliceContains(vmList, vmName)
+		if !exists {
+			errs[i] = utils.CmdResult{Name: vmName, Err: errors.New("unknown instance " + vmName)}
+			continue
+		}
+
+		err = withInstance(vmName, op, f)
+		if err != nil {
+			errs[i] = utils.CmdResult{Name: vmName, Err: err}
+			continue
+		}
+	}
+	wasErr := false
+	for _, res := range errs {
+		if res.Err != nil {
+			log.Printf("failed for %s: %v\n", res.Name, res.Err)
+			wasErr = true
+		}
+	}
+	if wasErr {
+		log.Fatalln(failMsg)
+	}
+}
+
+// withInstance reads the configuration of vmName and applies f to it, holding
+// the instance lock for op unless op is empty
+func withInstance(vmName string, op string, f func(machineConfig qemu.MachineConfig) error) error {
+	if op != "" {
+		lock, err := qemu.LockInstance(vmName, op, waitForLock)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+	}
+
+	machineConfig, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		return err
+	}
+	return f(machineConfig)
 }
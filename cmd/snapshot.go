@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/beringresearch/macpine/host"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/spf13/cobra"
+)
+
+// snapshotCmd manages instance snapshots
+var snapshotCmd = &cobra.Command{
+	Use:     "snapshot",
+	Short:   "Create, list, restore, and delete instance snapshots.",
+	Aliases: []string{"snap"},
+}
+
+var snapshotCreateCmd = &cobra.Command{
+	Use:   "create <instance> [<instance>...]",
+	Short: "Snapshot instances. Running instances also have their memory saved.",
+	Long: "Snapshot instances. Running instances also have their memory saved.\n\n" +
+		"Running instances that mount a host directory cannot be snapshot, as QEMU cannot save their memory. Stop them to snapshot their disk.",
+	Run: snapshotCreate,
+
+	ValidArgsFunction: host.AutoCompleteVMNamesOrTags,
+}
+
+var snapshotListCmd = &cobra.Command{
+	Use:     "list <instance> [<instance>...]",
+	Short:   "List instance snapshots.",
+	Run:     snapshotList,
+	Aliases: []string{"ls"},
+
+	ValidArgsFunction:     host.AutoCompleteVMNamesOrTags,
+	DisableFlagsInUseLine: true,
+}
+
+var snapshotRestoreCmd = &cobra.Command{
+	Use:     "restore -n <snapshot> <instance> [<instance>...]",
+	Short:   "Revert instances to a snapshot.",
+	Run:     snapshotRestore,
+	Aliases: []string{"revert"},
+
+	ValidArgsFunction: host.AutoCompleteVMNamesOrTags,
+}
+
+var snapshotDeleteCmd = &cobra.Command{
+	Use:     "delete -n <snapshot> <instance> [<instance>...]",
+	Short:   "Delete instance snapshots.",
+	Run:     snapshotDelete,
+	Aliases: []string{"del", "rm"},
+
+	ValidArgsFunction: host.AutoCompleteVMNamesOrTags,
+}
+
+var snapshotName, snapshotDescription string
+
+func init() {
+	snapshotCreateCmd.Flags().StringVarP(&snapshotName, "name", "n", "", "Snapshot name. Defaults to the current time.")
+	snapshotCreateCmd.Flags().StringVarP(&snapshotDescription, "description", "d", "", "Description of the snapshot.")
+	snapshotRestoreCmd.Flags().StringVarP(&snapshotName, "name", "n", "", "Name of the snapshot to restore.")
+	snapshotDeleteCmd.Flags().StringVarP(&snapshotName, "name", "n", "", "Name of the snapshot to delete.")
+	includeWaitFlag(snapshotCreateCmd)
+	includeWaitFlag(snapshotRestoreCmd)
+	includeWaitFlag(snapshotDeleteCmd)
+
+	snapshotCmd.AddCommand(snapshotCreateCmd)
+	snapshotCmd.AddCommand(snapshotListCmd)
+	snapshotCmd.AddCommand(snapshotRestoreCmd)
+	snapshotCmd.AddCommand(snapshotDeleteCmd)
+}
+
+func validateSnapshotName(name string) error {
+	if name == "" {
+		return errors.New("missing snapshot name (-n)")
+	}
+	format := regexp.MustCompile(`^[a-zA-Z0-9_\-\.]+$`)
+	if !format.MatchString(name) {
+		return errors.New("invalid snapshot name, accepted characters are [A-Za-z0-9], '.', '_', and '-'")
+	}
+	return nil
+}
+
+func snapshotCreate(cmd *cobra.Command, args []string) {
+	if snapshotName == "" {
+		snapshotName = time.Now().Format("20060102-150405")
+	}
+	if err := validateSnapshotName(snapshotName); err != nil {
+		log.Fatalln(err)
+	}
+
+	forEachInstance(args, "snapshot create", "error creating snapshot(s)", func(machineConfig qemu.MachineConfig) error {
+		return host.CreateSnapshot(machineConfig, snapshotName, snapshotDescription)
+	})
+}
+
+func snapshotRestore(cmd *cobra.Command, args []string) {
+	if err := validateSnapshotName(snapshotName); err != nil {
+		log.Fatalln(err)
+	}
+
+	forEachInstance(args, "snapshot restore", "error restoring snapshot(s)", func(machineConfig qemu.MachineConfig) error {
+		return host.RestoreSnapshot(machineConfig, snapshotName)
+	})
+}
+
+func snapshotDelete(cmd *cobra.Command, args []string) {
+	if err := validateSnapshotName(snapshotName); err != nil {
+		log.Fatalln(err)
+	}
+
+	forEachInstance(args, "snapshot delete", "error deleting snapshot(s)", func(machineConfig qemu.MachineConfig) error {
+		return host.DeleteSnapshot(machineConfig, snapshotName)
+	})
+}
+
+func snapshotList(cmd *cobra.Command, args []string) {
+	configs := []qemu.MachineConfig{}
+	forEachInstance(args, "", "error listing snapshot(s)", func(machineConfig qemu.MachineConfig) error {
+		configs = append(configs, machineConfig)
+		return nil
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tNAME\tCREATED\tMEMORY\tDESCRIPTION\t")
+	for _, machine := range configs {
+		for _, s := range machine.Snapshots {
+			memory := "no"
+			if s.VMState {
+				memory = "yes"
+			}
+			row := []string{
+				machine.Alias,
+				s.Name,
+				s.Created.Format(time.RFC822),
+				memory,
+				s.Description,
+			}
+			fmt.Fprintln(w, strings.Join(row, "    \t")+"    \t")
+		}
+	}
+	w.Flush()
+}
@@ -1,8 +1,10 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"github.com/beringresearch/macpine/host"
@@ -15,12 +17,21 @@ import (
 var shellCmd = &cobra.Command{
 	Use:   "ssh <instance>",
 	Short: "Attach an interactive shell to an instance via ssh.",
-	Run:   shell,
+	Long: "Attach an interactive shell to an instance via ssh.\n\n" +
+		"The host key of an instance is recorded on the first connection and checked on every later one. " +
+		"If the instance was legitimately rebuilt, --reset-host-key forgets the recorded key and records the new one.",
+	Run: shell,
 
 	ValidArgsFunction:     host.AutoCompleteVMNames,
 	DisableFlagsInUseLine: true,
 }
 
+var resetHostKey bool
+
+func init() {
+	shellCmd.Flags().BoolVar(&resetHostKey, "reset-host-key", false, "Forget the recorded host key of the instance and record the one it presents now.")
+}
+
 func shell(cmd *cobra.Command, args []string) {
 	if len(args) == 0 {
 		log.Fatal("missing instance name")
@@ -38,8 +49,14 @@ func shell(cmd *cobra.Command, args []string) {
 		log.Fatalln(err)
 	}
 
-	if status, _ := machineConfig.Status(); status != "Running" {
-		log.Fatalf("%s is not running", machineConfig.Alias)
+	if resetHostKey {
+		if err := machineConfig.ResetHostKey(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if _, _, err := machineConfig.RequireState("ssh into", qemu.StateRunning); err != nil {
+		log.Fatalln(err)
 	}
 
 	for {
@@ -48,8 +65,11 @@ func shell(cmd *cobra.Command, args []string) {
 		if err == nil {
 			break
 		}
+		if errors.Is(err, qemu.ErrHostKeyChanged) {
+			log.Fatalln(err)
+		}
 
-		fmt.Print(".")
+		fmt.Fprint(os.Stderr, ".")
 		time.Sleep(4 * time.Second)
 	}
 
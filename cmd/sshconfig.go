@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/beringresearch/macpine/host"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// sshConfigCmd prints OpenSSH configuration for instances
+var sshConfigCmd = &cobra.Command{
+	Use:   "ssh-config [<instance>|+<tag>...]",
+	Short: "Print OpenSSH Host entries for instances, for use with ssh, scp, rsync or VS Code Remote.",
+	Long: "Print OpenSSH Host entries for instances, for use with ssh, scp, rsync or VS Code Remote.\n\n" +
+		"Without arguments, entries for all instances are printed. With --install, they are written to\n" +
+		"~/.macpine/ssh_config instead, which is then updated on launch, clone, import, rename and delete.\n" +
+		"Add the following line at the top of ~/.ssh/config to use it:\n\n" +
+		"    Include ~/.macpine/ssh_config",
+	Run: sshConfig,
+
+	ValidArgsFunction: host.AutoCompleteVMNamesOrTags,
+}
+
+var sshConfigInstall bool
+
+func init() {
+	sshConfigCmd.Flags().BoolVar(&sshConfigInstall, "install", false, "Write entries for all instances to ~/.macpine/ssh_config and keep them up to date.")
+}
+
+func sshConfig(cmd *cobra.Command, args []string) {
+	if sshConfigInstall {
+		if len(args) > 0 {
+			log.Fatalln("--install writes entries for all instances and takes no instance names")
+		}
+		path, err := host.SSHConfigFile()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := host.InstallSSHConfig(); err != nil {
+			log.Fatalf("unable to write %s: %v\n", path, err)
+		}
+		log.Printf("wrote %s, include it at the top of ~/.ssh/config with: Include %s\n", path, path)
+		return
+	}
+
+	if len(args) == 0 {
+		args = host.ListVMNames()
+	}
+	args, err := host.ExpandTagArguments(args)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	vmList := host.ListVMNames()
+	printed := false
+	errs := make([]utils.CmdResult, len(args))
+	for i, vmName := range args {
+		if utils.StringSliceContains(args[:i], vmName) {
+			continue
+		}
+		if !utils.StringSliceContains(vmList, vmName) {
+			errs[i] = utils.CmdResult{Name: vmName, Err: errors.New("unknown instance " + vmName)}
+			continue
+		}
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			errs[i] = utils.CmdResult{Name: vmName, Err: err}
+			continue
+		}
+		if printed {
+			fmt.Println()
+		}
+		fmt.Print(host.SSHConfig(machineConfig))
+		printed = true
+	}
+	wasErr := false
+	for _, res := range errs {
+		if res.Err != nil {
+			log.Printf("error for %s: %v\n", res.Name, res.Err)
+			wasErr = true
+		}
+	}
+	if wasErr {
+		log.Fatalln("error printing ssh configuration")
+	}
+}
@@ -1,12 +1,10 @@
 package cmd
 
 import (
-	"errors"
 	"log"
 
 	"github.com/beringresearch/macpine/host"
 	"github.com/beringresearch/macpine/qemu"
-	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
 )
 
@@ -21,51 +19,35 @@ var stopCmd = &cobra.Command{
 	DisableFlagsInUseLine: true,
 }
 
-func stop(cmd *cobra.Command, args []string) {
-	if len(args) == 0 {
-		log.Fatal("missing instance name")
-	}
+var stopTimeout int
 
-	args, err := host.ExpandTagArguments(args)
-	if err != nil {
-		log.Fatalln(err)
-	}
+func init() {
+	includeStopFlags(stopCmd)
+	includeWaitFlag(stopCmd)
+}
 
-	vmList := host.ListVMNames()
-	errs := make([]utils.CmdResult, len(args))
-	for i, vmName := range args {
-		if utils.StringSliceContains(args[:i], vmName) {
-			continue
-		}
-		exists := utils.StringSliceContains(vmList, vmName)
-		if !exists {
-			errs[i] = utils.CmdResult{Name: vmName, Err: errors.New("unknown instance " + vmName)}
-			continue
-		}
+func includeStopFlags(cmd *cobra.Command) {
+	cmd.Flags().IntVarP(&stopTimeout, "timeout", "t", 0, "Seconds to wait for the guest to power down before forcing it off. Defaults to the instance's stoptimeout.")
+}
 
-		machineConfig, err := qemu.GetMachineConfig(vmName)
-		if err != nil {
-			errs[i] = utils.CmdResult{Name: vmName, Err: err}
-			continue
+func stop(cmd *cobra.Command, args []string) {
+	forEachInstance(args, "stop", "error stopping instance(s)", func(machineConfig qemu.MachineConfig) error {
+		if stopTimeout > 0 {
+			machineConfig.StopTimeout = stopTimeout
 		}
 
-		if status, _ := machineConfig.Status(); status == "Paused" {
+		status, _ := machineConfig.Status()
+		if status == qemu.StatePaused {
 			host.Resume(machineConfig)
 		}
-		err = host.Stop(machineConfig)
-		if err != nil {
-			errs[i] = utils.CmdResult{Name: vmName, Err: err}
-			continue
-		}
-	}
-	wasErr := false
-	for _, res := range errs {
-		if res.Err != nil {
-			log.Printf("failed: %v\n", res.Err)
-			wasErr = true
+		if status == qemu.StateSaved {
+			err := machineConfig.DiscardSavedState()
+			if err != nil {
+				return err
+			}
+			log.Println("discarded saved state of " + machineConfig.Alias)
+			return nil
 		}
-	}
-	if wasErr {
-		log.Fatalln("error stopping instance(s)")
-	}
+		return host.Stop(machineConfig)
+	})
 }
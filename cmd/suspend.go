@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"github.com/beringresearch/macpine/host"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/spf13/cobra"
+)
+
+// suspendCmd saves an Alpine instance to disk
+var suspendCmd = &cobra.Command{
+	Use:   "suspend <instance> [<instance>...]",
+	Short: "Save running instances to disk and stop them. Restore with `alpine start` or `alpine resume`.",
+	Long: "Save running instances to disk and stop them. Restore with `alpine start` or `alpine resume`.\n\n" +
+		"Suspending requires QEMU 8.2 or newer, and is not possible for instances that mount a host directory.",
+	Run:     suspend,
+	Aliases: []string{"hibernate"},
+
+	ValidArgsFunction:     host.AutoCompleteVMNamesOrTags,
+	DisableFlagsInUseLine: true,
+}
+
+func init() {
+	includeWaitFlag(suspendCmd)
+}
+
+func suspend(cmd *cobra.Command, args []string) {
+	forEachInstance(args, "suspend", "error suspending instance(s)", func(machineConfig qemu.MachineConfig) error {
+		return host.Suspend(machineConfig)
+	})
+}
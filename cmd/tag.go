@@ -15,6 +15,7 @@ var remove bool
 
 func init() {
 	includeTagFlag(tagCmd)
+	includeWaitFlag(tagCmd)
 }
 
 func includeTagFlag(cmd *cobra.Command) {
@@ -47,6 +48,12 @@ func macpineTag(cmd *cobra.Command, args []string) {
 	tags := args[1:]
 	validateTags(tags)
 
+	lock, err := qemu.LockInstance(vmName, "tag", waitForLock)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer lock.Unlock()
+
 	machineConfig, err := qemu.GetMachineConfig(vmName)
 	if err != nil {
 		log.Fatalln(err)
@@ -0,0 +1,92 @@
+package host
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/beringresearch/macpine/qemu"
+)
+
+// CacheImage is a cached base image and the instances whose disks depend on it
+type CacheImage struct {
+	Name  string
+	Path  string
+	Size  int64
+	Users []string
+}
+
+// ListCacheImages returns the qcow2 images in the cache
+func ListCacheImages() ([]CacheImage, error) {
+	cacheDir, err := qemu.CacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	dirList, err := os.ReadDir(cacheDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	users, err := cacheImageUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	var images []CacheImage
+	for _, f := range dirList {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".qcow2") {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(cacheDir, f.Name())
+		images = append(images, CacheImage{
+			Name:  f.Name(),
+			Path:  path,
+			Size:  info.Size(),
+			Users: users[path],
+		})
+	}
+	return images, nil
+}
+
+// RemoveCacheImage deletes a cached image and its checksum. Images that an
+// instance disk still depends on are refused.
+func RemoveCacheImage(image CacheImage) error {
+	if len(image.Users) > 0 {
+		return errors.New(image.Name + " is in use by " + strings.Join(image.Users, ", "))
+	}
+
+	err := os.Remove(image.Path)
+	if err != nil {
+		return err
+	}
+	os.Remove(image.Path + ".sha256")
+	return nil
+}
+
+// cacheImageUsers maps each image in any instance's backing chain to the
+// instances that depend on it
+func cacheImageUsers() (map[string][]string, error) {
+	users := make(map[string][]string)
+	for _, vmName := range ListVMNames() {
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			return nil, err
+		}
+
+		// fail closed: an unreadable chain could hide a dependency
+		chain, err := machineConfig.BackingChain()
+		if err != nil {
+			return nil, errors.New("unable to inspect disk of " + vmName + ": " + err.Error())
+		}
+		for _, image := range chain {
+			users[image] = append(users[image], vmName)
+		}
+	}
+	return users, nil
+}
@@ -0,0 +1,41 @@
+package host
+
+import (
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+)
+
+// Clone creates a new instance from an existing one, with its own MAC address,
+// SSH port and host ports for the forwards of the source
+func Clone(config qemu.MachineConfig, name string, full bool, snapshot string) error {
+	// instances on a host network keep ssh on port 22 of their own address
+	sshPort := config.SSHPort
+	ports := config.Port
+	if !config.HostNetwork() {
+		var err error
+		sshPort, err = FreeSSHPort(name)
+		if err != nil {
+			return err
+		}
+
+		// the same guest ports are forwarded from free host ports
+		maps, err := utils.ParsePort(config.Port)
+		if err != nil {
+			return err
+		}
+		for i := range maps {
+			maps[i].Auto = true
+		}
+		if err := allocateAutoPorts(qemu.MachineConfig{Alias: name, SSHPort: sshPort}, maps); err != nil {
+			return err
+		}
+		ports = utils.FormatPorts(maps)
+	}
+
+	if _, err := config.Clone(name, sshPort, ports, full, snapshot); err != nil {
+		return err
+	}
+
+	UpdateSSHConfig()
+	return nil
+}
@@ -1,12 +1,15 @@
 package host
 
 import (
+	"os"
+
 	"github.com/beringresearch/macpine/qemu"
 )
 
-// Exec executes a command inside VM
+// Exec executes a command inside VM, connected to the standard streams of
+// the host. A command that exits non-zero returns an *ssh.ExitError.
 func Exec(config qemu.MachineConfig, cmd string) error {
 
-	_, err := config.Exec(cmd, false)
-	return err // false: run as default ssh user, not (necessarily) root
+	// false: run as default ssh user, not (necessarily) root
+	return config.ExecStream(cmd, false, os.Stdin, os.Stdout, os.Stderr)
 }
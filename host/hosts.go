@@ -0,0 +1,238 @@
+package host
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+)
+
+// HostsDomain is the domain under which instances are named, as in
+// alias.macpine.local
+const HostsDomain = "macpine.local"
+
+// SystemHostsFile is the hosts file of the host
+const SystemHostsFile = "/etc/hosts"
+
+// guestHostsTimeout bounds the update of the hosts file of each instance
+const guestHostsTimeout = 5 * time.Second
+
+const (
+	hostsBegin = "# BEGIN macpine"
+	hostsEnd   = "# END macpine"
+)
+
+// HostsEntry names the address of an instance
+type HostsEntry struct {
+	IP   string
+	Name string
+}
+
+func (e HostsEntry) String() string {
+	return e.IP + " " + e.Name
+}
+
+// hostsInstance is a running instance and, on a host network, its address
+type hostsInstance struct {
+	config qemu.MachineConfig
+	ip     string
+}
+
+// runningInstances lists the running instances, with the known addresses of
+// those on host networks. Instances whose address is not known yet are left
+// out, as discovering it may take a while.
+func runningInstances() []hostsInstance {
+	var running []hostsInstance
+	for _, vmName := range ListVMNames() {
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			continue
+		}
+		if status, _ := machineConfig.Status(); !status.Active() {
+			continue
+		}
+
+		instance := hostsInstance{config: machineConfig}
+		if machineConfig.HostNetwork() {
+			ip, ok := machineConfig.KnownIP()
+			if !ok {
+				log.Println("no hosts entry for " + vmName + ", its address is not known yet")
+				continue
+			}
+			instance.ip = ip
+		}
+		running = append(running, instance)
+	}
+	return running
+}
+
+// HostsEntries returns the names of running instances as seen from the host,
+// or from the guest of view if it is not nil
+func HostsEntries(view *qemu.MachineConfig) []HostsEntry {
+	return hostsView(runningInstances(), view)
+}
+
+// hostsView returns the names of instances as seen from the host, or from the
+// guest of view if it is not nil. Instances on the user network are reached
+// through the ports forwarded on the host, which a guest on the user network
+// reaches at its slirp host address.
+func hostsView(instances []hostsInstance, view *qemu.MachineConfig) []HostsEntry {
+	var entries []HostsEntry
+	for _, instance := range instances {
+		name := instance.config.Alias + "." + HostsDomain
+		switch {
+		case view != nil && view.Alias == instance.config.Alias:
+			entries = append(entries, HostsEntry{IP: "127.0.0.1", Name: name})
+		case instance.ip != "":
+			entries = append(entries, HostsEntry{IP: instance.ip, Name: name})
+		case view == nil:
+			entries = append(entries, HostsEntry{IP: "127.0.0.1", Name: name})
+		case !view.HostNetwork():
+			entries = append(entries, HostsEntry{IP: view.SlirpHost(), Name: name})
+		}
+	}
+	return entries
+}
+
+// UpdateHosts brings the names of running instances up to date in
+// ~/.macpine/hosts, in the macpine section of the system hosts file if it has
+// one, and in the hosts file of every running instance that asks for them,
+// giving each guestHostsTimeout. Failures are logged, as names are a
+// convenience that must not fail the operation that changed them.
+func UpdateHosts() {
+	instances := runningInstances()
+	entries := hostsView(instances, nil)
+
+	if err := writeMacpineHosts(entries); err != nil {
+		log.Println("unable to update hosts: " + err.Error())
+	}
+	if err := updateHostsSection(SystemHostsFile, entries, false); err != nil {
+		log.Println("unable to update " + SystemHostsFile + ": " + err.Error())
+	}
+
+	var wg sync.WaitGroup
+	for _, instance := range instances {
+		machineConfig := instance.config
+		if !machineConfig.Hosts {
+			continue
+		}
+		if status, _ := machineConfig.Status(); status != qemu.StateRunning {
+			continue
+		}
+
+		wg.Add(1)
+		go func(machineConfig qemu.MachineConfig) {
+			defer wg.Done()
+			// an unreachable guest must not hold up the command that
+			// changed the instances
+			done := make(chan error, 1)
+			go func() {
+				done <- syncGuestHosts(machineConfig, hostsView(instances, &machineConfig))
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					log.Println("unable to update hosts of " + machineConfig.Alias + ": " + err.Error())
+				}
+			case <-time.After(guestHostsTimeout):
+				log.Println("unable to update hosts of " + machineConfig.Alias + ": timed out")
+			}
+		}(machineConfig)
+	}
+	wg.Wait()
+}
+
+// InstallHosts adds a macpine section to the system hosts file, which is
+// then kept up to date whenever it is writable
+func InstallHosts() error {
+	return updateHostsSection(SystemHostsFile, HostsEntries(nil), true)
+}
+
+// UninstallHosts removes the macpine section from the system hosts file
+func UninstallHosts() error {
+	path := SystemHostsFile
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines, found := removeHostsSection(strings.Split(string(content), "\n"))
+	if !found {
+		return errors.New("no macpine section in " + path)
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+// writeMacpineHosts writes the host view of the names to ~/.macpine/hosts,
+// which can be given to a local resolver such as dnsmasq
+func writeMacpineHosts(entries []HostsEntry) error {
+	userHomeDir, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	var content string
+	for _, entry := range entries {
+		content += entry.String() + "\n"
+	}
+	return utils.WriteFileAtomic(filepath.Join(userHomeDir, ".macpine", "hosts"), []byte(content), 0644)
+}
+
+// updateHostsSection replaces the macpine section of the hosts file at path.
+// Files without a section are left alone unless add is set.
+func updateHostsSection(path string, entries []HostsEntry, add bool) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	lines, found := removeHostsSection(strings.Split(strings.TrimRight(string(content), "\n"), "\n"))
+	if !found && !add {
+		return nil
+	}
+
+	lines = append(lines, hostsBegin)
+	for _, entry := range entries {
+		lines = append(lines, entry.String())
+	}
+	lines = append(lines, hostsEnd)
+
+	// written in place, as the hosts file is shared with the rest of the
+	// system and keeps its owner and permissions
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// removeHostsSection drops the macpine section from the lines of a hosts file
+func removeHostsSection(lines []string) ([]string, bool) {
+	var kept []string
+	found, inside := false, false
+	for _, line := range lines {
+		switch {
+		case line == hostsBegin:
+			found, inside = true, true
+		case line == hostsEnd && inside:
+			inside = false
+		case !inside:
+			kept = append(kept, line)
+		}
+	}
+	return kept, found
+}
+
+// syncGuestHosts writes the guest view of the names to the hosts file of an
+// instance
+func syncGuestHosts(config qemu.MachineConfig, entries []HostsEntry) error {
+	section := []string{hostsBegin}
+	for _, entry := range entries {
+		section = append(section, entry.String())
+	}
+	section = append(section, hostsEnd)
+
+	_, err := config.Exec("sed -i '/^"+hostsBegin+"$/,/^"+hostsEnd+"$/d' /etc/hosts && "+
+		"printf '%s\\n' '"+strings.Join(section, "' '")+"' >> /etc/hosts", true)
+	return err
+}
@@ -0,0 +1,113 @@
+package host
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+)
+
+// NetworkInfo is a network and the instances attached to it
+type NetworkInfo struct {
+	qemu.Network
+	Users []string
+}
+
+// ListNetworks returns every network and the instances attached to it
+func ListNetworks() ([]NetworkInfo, error) {
+	networks, err := qemu.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	users := networkUsers()
+	infos := make([]NetworkInfo, len(networks))
+	for i, network := range networks {
+		infos[i] = NetworkInfo{Network: network, Users: users[network.Name]}
+	}
+	return infos, nil
+}
+
+// RemoveNetwork deletes a network. Networks that instances are still attached
+// to are refused.
+func RemoveNetwork(name string) error {
+	if users := networkUsers()[name]; len(users) > 0 {
+		return errors.New(name + " is in use by " + strings.Join(users, ", "))
+	}
+	return qemu.DeleteNetwork(name)
+}
+
+// AttachNetwork adds an interface on a network to a stopped instance
+func AttachNetwork(config qemu.MachineConfig, network string, ip string) error {
+	return config.AttachNetwork(network, ip)
+}
+
+// DetachNetwork removes the interface on a network from a stopped instance
+func DetachNetwork(config qemu.MachineConfig, network string) error {
+	return config.DetachNetwork(network)
+}
+
+// networkUsers maps each network to the instances attached to it
+func networkUsers() map[string][]string {
+	users := make(map[string][]string)
+	for _, vmName := range ListVMNames() {
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			continue
+		}
+		for _, nic := range machineConfig.NICs {
+			users[nic.Network] = append(users[nic.Network], vmName)
+		}
+	}
+	return users
+}
+
+// ensureSwitches starts a detached switch for every network the instance is
+// attached to, unless one is already accepting instances
+func ensureSwitches(config qemu.MachineConfig) error {
+	for _, nic := range config.NICs {
+		network, err := qemu.GetNetwork(nic.Network)
+		if err != nil {
+			return err
+		}
+		socket, err := network.SwitchSocket()
+		if err != nil {
+			return err
+		}
+
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			continue
+		}
+
+		self, err := os.Executable()
+		if err != nil {
+			return err
+		}
+
+		sw := exec.Command(self, "network", "serve", network.Name)
+		sw.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		if err := sw.Start(); err != nil {
+			return err
+		}
+		sw.Process.Release()
+
+		err = utils.Retry(20, 250*time.Millisecond, func() error {
+			conn, err := net.Dial("unix", socket)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		})
+		if err != nil {
+			return errors.New("unable to start the switch of network " + network.Name + ": " + err.Error())
+		}
+	}
+	return nil
+}
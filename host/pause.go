@@ -9,6 +9,20 @@ func Pause(config qemu.MachineConfig) error {
 	return config.Pause()
 }
 
+// Resume unpauses a VM, or restores one that was suspended to disk
 func Resume(config qemu.MachineConfig) error {
+	if status, _ := config.Status(); status == qemu.StateSaved {
+		return Start(config)
+	}
 	return config.Resume()
 }
+
+// Suspend saves a VM's state to disk and stops it
+func Suspend(config qemu.MachineConfig) error {
+	if err := config.Suspend(); err != nil {
+		return err
+	}
+
+	UpdateHosts()
+	return nil
+}
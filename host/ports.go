@@ -0,0 +1,201 @@
+package host
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+)
+
+// DefaultPortRange is where auto ports are allocated from, unless
+// MACPINE_PORT_RANGE is set
+const DefaultPortRange = "2022-49151"
+
+// AddPorts forwards host ports to an instance, live if it is running
+func AddPorts(config qemu.MachineConfig, ports string) error {
+	maps, err := utils.ParsePort(ports)
+	if err != nil {
+		return err
+	}
+	var fixed []utils.PortMap
+	for _, p := range maps {
+		if !p.Auto {
+			fixed = append(fixed, p)
+		}
+	}
+	if err := checkReservedPorts(config, fixed); err != nil {
+		return err
+	}
+	if err := checkPortsFree(fixed); err != nil {
+		return err
+	}
+	if err := allocateAutoPorts(config, maps); err != nil {
+		return err
+	}
+	return config.AddPorts(utils.FormatPorts(maps))
+}
+
+// RemovePorts stops forwarding host ports to an instance, live if it is running
+func RemovePorts(config qemu.MachineConfig, ports string) error {
+	return config.RemovePorts(ports)
+}
+
+// AllocatePorts replaces an auto ssh port and auto port mappings of an
+// instance with free host ports. Ports configured on other instances are
+// never handed out, whether those instances are running or not.
+func AllocatePorts(config *qemu.MachineConfig) error {
+	// instances on a host network are reached directly on their own address
+	if config.HostNetwork() {
+		if config.SSHPort == "auto" {
+			config.SSHPort = "22"
+		}
+		return nil
+	}
+
+	maps, err := utils.ParsePort(config.Port)
+	if err != nil {
+		return err
+	}
+	if config.SSHPort == "auto" {
+		ssh := utils.PortMap{Guest: 22, Count: 1, Proto: utils.Tcp, Auto: true}
+		maps = append([]utils.PortMap{ssh}, maps...)
+	}
+	if err := allocateAutoPorts(*config, maps); err != nil {
+		return err
+	}
+
+	if config.SSHPort == "auto" {
+		config.SSHPort = strconv.Itoa(maps[0].Host)
+		maps = maps[1:]
+	}
+	config.Port = utils.FormatPorts(maps)
+	return nil
+}
+
+// FreeSSHPort returns a free host port for the ssh port of instance alias
+func FreeSSHPort(alias string) (string, error) {
+	config := qemu.MachineConfig{Alias: alias, SSHPort: "auto"}
+	if err := AllocatePorts(&config); err != nil {
+		return "", err
+	}
+	return config.SSHPort, nil
+}
+
+// allocateAutoPorts assigns free host ports to the auto mappings in maps for
+// an instance, avoiding its ssh port, the other mappings in maps and the ports
+// configured on every instance
+func allocateAutoPorts(config qemu.MachineConfig, maps []utils.PortMap) error {
+	reserved := reservedPorts()
+	if port, err := strconv.Atoi(config.SSHPort); err == nil {
+		reserved = append(reserved, utils.PortMap{Host: port, Count: 1, Proto: utils.Tcp})
+	}
+	for _, p := range maps {
+		if !p.Auto {
+			reserved = append(reserved, p)
+		}
+	}
+
+	for i, p := range maps {
+		if !p.Auto {
+			continue
+		}
+		port, err := freePorts(p, reserved)
+		if err != nil {
+			return err
+		}
+		maps[i].Host = port
+		maps[i].Auto = false
+		reserved = append(reserved, maps[i])
+	}
+	return nil
+}
+
+// freePorts returns the first of p.Count consecutive host ports in the
+// allocation range that are not reserved and that nothing is listening on
+func freePorts(p utils.PortMap, reserved []utils.PortMap) (int, error) {
+	portRange := os.Getenv("MACPINE_PORT_RANGE")
+	if portRange == "" {
+		portRange = DefaultPortRange
+	}
+	first, count, err := utils.ParsePortRange(portRange)
+	if err != nil {
+		return 0, errors.New("invalid MACPINE_PORT_RANGE " + portRange + ": " + err.Error())
+	}
+
+	address := p.Address
+	if address == "" || net.ParseIP(address).IsUnspecified() {
+		address = "localhost"
+	}
+
+	for start := first; start+p.Count <= first+count; start++ {
+		candidate := utils.PortMap{Address: p.Address, Host: start, Count: p.Count, Proto: p.Proto}
+		free := true
+		for _, r := range reserved {
+			if candidate.Overlaps(r) {
+				free = false
+				break
+			}
+		}
+		for port := start; free && port < start+p.Count; port++ {
+			free = utils.Ping(address, strconv.Itoa(port)) == nil
+		}
+		if free {
+			return start, nil
+		}
+	}
+	return 0, errors.New("no free host ports left in " + portRange + " for " + p.String())
+}
+
+// reservedPorts returns the host ports configured on every instance
+func reservedPorts() []utils.PortMap {
+	var reserved []utils.PortMap
+	for _, vmName := range ListVMNames() {
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			continue
+		}
+		reserved = append(reserved, instancePorts(machineConfig)...)
+	}
+	return reserved
+}
+
+// checkReservedPorts returns an error if maps overlap the host ports
+// configured on any instance other than config
+func checkReservedPorts(config qemu.MachineConfig, maps []utils.PortMap) error {
+	for _, vmName := range ListVMNames() {
+		if vmName == config.Alias {
+			continue
+		}
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			continue
+		}
+		for _, r := range instancePorts(machineConfig) {
+			for _, p := range maps {
+				if p.Overlaps(r) {
+					return errors.New("host port(s) " + p.String() + " are reserved by " + vmName)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// instancePorts returns the ssh port and forwarded host ports of an instance
+func instancePorts(config qemu.MachineConfig) []utils.PortMap {
+	var ports []utils.PortMap
+	if port, err := strconv.Atoi(config.SSHPort); err == nil {
+		ports = append(ports, utils.PortMap{Host: port, Count: 1, Proto: utils.Tcp})
+	}
+	if maps, err := utils.ParsePort(config.Port); err == nil {
+		for _, p := range maps {
+			if !p.Auto {
+				ports = append(ports, p)
+			}
+		}
+	}
+	return ports
+}
@@ -0,0 +1,20 @@
+package host
+
+import (
+	"github.com/beringresearch/macpine/qemu"
+)
+
+// CreateSnapshot checkpoints an instance under the given name
+func CreateSnapshot(config qemu.MachineConfig, name string, description string) error {
+	return config.CreateSnapshot(name, description)
+}
+
+// RestoreSnapshot reverts an instance to a named snapshot
+func RestoreSnapshot(config qemu.MachineConfig, name string) error {
+	return config.RestoreSnapshot(name)
+}
+
+// DeleteSnapshot removes a named snapshot from an instance
+func DeleteSnapshot(config qemu.MachineConfig, name string) error {
+	return config.DeleteSnapshot(name)
+}
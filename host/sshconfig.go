@@ -0,0 +1,89 @@
+package host
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+)
+
+// SSHConfigFile is the OpenSSH configuration of all instances kept by
+// alpine ssh-config --install, for an Include in ~/.ssh/config
+func SSHConfigFile() (string, error) {
+	userHomeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(userHomeDir, ".macpine", "ssh_config"), nil
+}
+
+// SSHConfig returns the OpenSSH Host block of an instance. The host key is
+// checked against the known_hosts of the instance, which OpenSSH shares with
+// alpine exec and alpine ssh. Credentials other than key:: are not resolved,
+// as they may run a command or need a password.
+func SSHConfig(config qemu.MachineConfig) string {
+	lines := []string{
+		"Host " + config.Alias,
+		"HostName " + config.MachineIP,
+		"Port " + config.SSHPort,
+		"User " + config.SSHUser,
+	}
+	if strings.HasPrefix(config.SSHPassword, "key::") {
+		lines = append(lines,
+			"IdentityFile "+sshConfigQuote(config.KeyPath(strings.TrimPrefix(config.SSHPassword, "key::"))),
+			"IdentitiesOnly yes")
+	}
+	lines = append(lines,
+		"HostKeyAlias "+qemu.HostKeyAlias,
+		"UserKnownHostsFile "+sshConfigQuote(config.KnownHostsFile()),
+		"StrictHostKeyChecking accept-new")
+
+	return lines[0] + "\n    " + strings.Join(lines[1:], "\n    ") + "\n"
+}
+
+// sshConfigQuote quotes a path for ssh_config if it has spaces
+func sshConfigQuote(path string) string {
+	if strings.ContainsAny(path, " \t") {
+		return "\"" + path + "\""
+	}
+	return path
+}
+
+// InstallSSHConfig writes the Host blocks of all instances to SSHConfigFile,
+// which is then kept up to date on launch, clone, import, rename and delete
+func InstallSSHConfig() error {
+	path, err := SSHConfigFile()
+	if err != nil {
+		return err
+	}
+
+	content := "# written by alpine ssh-config --install, changes are overwritten\n"
+	for _, vmName := range ListVMNames() {
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			continue
+		}
+		content += "\n" + SSHConfig(machineConfig)
+	}
+	return utils.WriteFileAtomic(path, []byte(content), 0600)
+}
+
+// UpdateSSHConfig rewrites SSHConfigFile if it was installed. Failures are
+// logged, as the file is a convenience that must not fail the command that
+// changed the instances.
+func UpdateSSHConfig() {
+	path, err := SSHConfigFile()
+	if err != nil {
+		return
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err := InstallSSHConfig(); err != nil {
+		log.Println("unable to update " + path + ": " + err.Error())
+	}
+}
@@ -5,6 +5,6 @@ import (
 )
 
 // Status launches a new VM using user-defined configuration
-func Status(config qemu.MachineConfig) (string, int) {
+func Status(config qemu.MachineConfig) (qemu.State, int) {
 	return config.Status() // status, pid
 }
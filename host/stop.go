@@ -6,5 +6,10 @@ import (
 
 // Stop launches a new VM using user-defined configuration
 func Stop(config qemu.MachineConfig) error {
-	return config.Stop()
+	if err := config.Stop(); err != nil {
+		return err
+	}
+
+	UpdateHosts()
+	return nil
 }
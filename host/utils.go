@@ -2,11 +2,14 @@ package host
 
 import (
 	"errors"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
 )
 
@@ -25,7 +28,7 @@ func ListVMNames() []string {
 
 	for _, f := range dirList {
 		if f.IsDir() {
-			if f.Name() != "cache" {
+			if f.Name() != "cache" && f.Name() != "networks" {
 				vmList = append(vmList, f.Name())
 			}
 		}
@@ -54,24 +57,12 @@ func AutoCompleteVMNamesOrTags(cmd *cobra.Command, args []string, toComplete str
 func ListTags() ([]string, error) {
 	var tagList []string
 
-	userHomeDir, err := os.UserHomeDir()
-	if err != nil {
-		return nil, err
-	}
-
-	dirList, err := os.ReadDir(filepath.Join(userHomeDir, ".macpine"))
-	if err != nil {
-		return nil, err
-	}
-
-	for _, f := range dirList {
-		if f.Name() != "cache" {
-			machineConfig, err := qemu.GetMachineConfig(f.Name())
-			if err != nil {
-				return nil, err
-			}
-			tagList = append(tagList, machineConfig.Tags...)
+	for _, vmName := range ListVMNames() {
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			return nil, err
 		}
+		tagList = append(tagList, machineConfig.Tags...)
 	}
 	return tagList, nil
 }
@@ -90,28 +81,16 @@ func ExpandTagArguments(args []string) ([]string, error) {
 		return args, nil
 	}
 
-	userHomeDir, err := os.UserHomeDir()
-	if err != nil {
-		return nil, err
-	}
-
-	dirList, err := os.ReadDir(filepath.Join(userHomeDir, ".macpine"))
-	if err != nil {
-		return nil, err
-	}
-
-	for _, f := range dirList {
-		if f.Name() != "cache" {
-			machineConfig, err := qemu.GetMachineConfig(f.Name())
-			if err != nil {
-				return nil, err
-			}
-			for _, tag := range machineConfig.Tags {
-				if arr, ok := tagMap[tag]; ok {
-					tagMap[tag] = append(arr, f.Name())
-				} else {
-					tagMap[tag] = []string{f.Name()}
-				}
+	for _, vmName := range ListVMNames() {
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range machineConfig.Tags {
+			if arr, ok := tagMap[tag]; ok {
+				tagMap[tag] = append(arr, vmName)
+			} else {
+				tagMap[tag] = []string{vmName}
 			}
 		}
 	}
@@ -130,3 +109,38 @@ func ExpandTagArguments(args []string) ([]string, error) {
 
 	return expandedArgs, nil
 }
+
+// checkHostPorts returns an error if anything on the host is listening on the
+// ssh port or a forwarded port of an instance
+func checkHostPorts(config qemu.MachineConfig) error {
+	ports, err := utils.ParsePort(config.Port)
+	if err != nil {
+		return err
+	}
+
+	sshPort := config.SSHPort
+	if strings.Contains(sshPort, ":") {
+		sshPort = strings.Split(sshPort, ":")[0]
+	}
+	if err := utils.Ping("localhost", sshPort); err != nil {
+		return err
+	}
+	return checkPortsFree(ports)
+}
+
+// checkPortsFree returns an error if anything on the host is listening on the
+// host ports of maps
+func checkPortsFree(maps []utils.PortMap) error {
+	for _, p := range maps {
+		address := p.Address
+		if address == "" || net.ParseIP(address).IsUnspecified() {
+			address = "localhost"
+		}
+		for _, q := range p.Expand() {
+			if err := utils.Ping(address, strconv.Itoa(q.Host)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package qemu
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/beringresearch/macpine/utils"
+)
+
+// CacheDir returns the directory holding downloaded and shared base images
+func CacheDir() (string, error) {
+	userHomeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(userHomeDir, ".macpine", "cache"), nil
+}
+
+// SealCacheImage records the checksum of a cached image the first time it is
+// seen and makes it read-only. Later calls verify the image against that
+// checksum, since instances may be overlays of it.
+func SealCacheImage(path string) error {
+	sumFile := path + ".sha256"
+
+	sum, err := utils.FileSHA256(path)
+	if err != nil {
+		return err
+	}
+
+	recorded, err := os.ReadFile(sumFile)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := os.WriteFile(sumFile, []byte(sum+"\n"), 0444); err != nil {
+			return err
+		}
+		return os.Chmod(path, 0444)
+	}
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(string(recorded)) != sum {
+		return errors.New("cached image " + path + " does not match its recorded checksum. delete it to download it again")
+	}
+	return nil
+}
+
+// BackingChain returns the images the instance disk depends on, starting with
+// its immediate backing file
+func (c *MachineConfig) BackingChain() ([]string, error) {
+	if !utils.CommandExists("qemu-img") {
+		return nil, errors.New("qemu-img is not available on $PATH. ensure qemu is installed")
+	}
+
+	out, err := exec.Command("qemu-img", "info", "-U", "--backing-chain", "--output=json",
+		filepath.Join(c.Location, c.Image)).Output()
+	if err != nil {
+		return nil, fmt.Errorf("qemu-img info: %v", err)
+	}
+
+	var images []struct {
+		Filename string `json:"filename"`
+	}
+	if err := json.Unmarshal(out, &images); err != nil {
+		return nil, err
+	}
+
+	chain := []string{}
+	for i, image := range images {
+		if i > 0 { // the first entry is the disk itself
+			chain = append(chain, image.Filename)
+		}
+	}
+	return chain, nil
+}
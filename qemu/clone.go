@@ -0,0 +1,213 @@
+package qemu
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/beringresearch/macpine/utils"
+)
+
+// Clone creates a new instance named alias from this one. A linked clone
+// shares the source disk through a qcow2 backing file; a full clone, or one
+// taken from a snapshot, gets an independent copy of the disk. Running
+// instances can only be cloned from a snapshot.
+func (c *MachineConfig) Clone(alias string, sshPort string, ports string, full bool, snapshot string) (MachineConfig, error) {
+	clone := *c
+
+	if !utils.CommandExists("qemu-img") {
+		return clone, errors.New("qemu-img is not available on $PATH. ensure qemu is installed")
+	}
+
+	if snapshot == "" {
+		if _, _, err := c.RequireState("clone", StateStopped); err != nil {
+			return clone, errors.New(err.Error() + ". snapshot it with `alpine snapshot create` and clone with --snapshot")
+		}
+	}
+	if snapshot != "" && c.GetSnapshot(snapshot) == nil {
+		return clone, errors.New("unknown snapshot " + snapshot)
+	}
+	if !full && snapshot == "" && len(c.Snapshots) > 0 {
+		return clone, errors.New(c.Alias + " has snapshots, which a linked clone cannot share. use --full or delete them")
+	}
+
+	macAddress, err := utils.GenerateMACAddress()
+	if err != nil {
+		return clone, err
+	}
+
+	clone.Alias = alias
+	clone.Location = filepath.Join(filepath.Dir(c.Location), alias)
+	clone.MACAddress = macAddress
+	clone.MachineIP = "localhost"
+	clone.SSHPort = sshPort
+	clone.Port = ports
+	clone.Snapshots = nil
+
+	// a clone is a new host on each network, and keeps no static address
+	clone.NICs = make([]NIC, len(c.NICs))
+	for i, nic := range c.NICs {
+		clone.NICs[i] = NIC{Network: nic.Network}
+		clone.NICs[i].MACAddress, err = utils.GenerateMACAddress()
+		if err != nil {
+			return clone, err
+		}
+	}
+
+	if exists, _ := utils.DirExists(clone.Location); exists {
+		return clone, errors.New("instance with name \"" + alias + "\" already exists")
+	}
+	if err := os.MkdirAll(clone.Location, os.ModePerm); err != nil {
+		return clone, err
+	}
+
+	source := filepath.Join(c.Location, c.Image)
+	target := filepath.Join(clone.Location, clone.Image)
+
+	if full || snapshot != "" {
+		args := []string{"convert", "-U", "-O", "qcow2"}
+		if snapshot != "" {
+			args = append(args, "-l", "snapshot.name="+snapshot)
+		}
+		args = append(args, source, target)
+		if out, err := exec.Command("qemu-img", args...).CombinedOutput(); err != nil {
+			os.RemoveAll(clone.Location)
+			return clone, fmt.Errorf("qemu-img convert: %v: %s", err, out)
+		}
+		clone.Backing = ""
+	} else {
+		base, err := c.freezeDisk()
+		if err != nil {
+			os.RemoveAll(clone.Location)
+			return clone, err
+		}
+		if err := createOverlay(base, target); err != nil {
+			os.RemoveAll(clone.Location)
+			return clone, err
+		}
+		clone.Backing = base
+	}
+
+	if c.Arch == "aarch64" {
+		_, err = utils.CopyFile(filepath.Join(c.Location, "qemu_efi.fd"), filepath.Join(clone.Location, "qemu_efi.fd"))
+		if err != nil {
+			os.RemoveAll(clone.Location)
+			return clone, err
+		}
+	}
+
+	// the disk authorizes the keypair of the source, which the clone logs in
+	// with until it has a keypair of its own, and has the same root password
+	files := map[string]string{RootPasswordFile: RootPasswordFile}
+	if c.SSHPassword == "key::"+SSHKeyFile {
+		files[SSHKeyFile] = sourceKeyFile
+		files[SSHKeyFile+".pub"] = sourceKeyFile + ".pub"
+		clone.SSHPassword = "key::" + sourceKeyFile
+	}
+	for from, to := range files {
+		content, err := os.ReadFile(filepath.Join(c.Location, from))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			err = utils.WriteFileAtomic(filepath.Join(clone.Location, to), content, 0600)
+		}
+		if err != nil {
+			os.RemoveAll(clone.Location)
+			return clone, err
+		}
+	}
+
+	// the keys shared with the source are replaced on the first start
+	if err := os.WriteFile(clone.rekeyMarker(), nil, 0644); err != nil {
+		os.RemoveAll(clone.Location)
+		return clone, err
+	}
+
+	if err := SaveMachineConfig(clone); err != nil {
+		os.RemoveAll(clone.Location)
+		return clone, err
+	}
+
+	log.Println("cloned " + c.Alias + " to " + clone.Alias)
+	return clone, nil
+}
+
+// freezeDisk moves the instance disk into the cache as an immutable base image
+// and replaces it with a copy-on-write overlay, so that the base can be shared
+// with clones. It returns the path of the base image. On failure the disk is
+// moved back.
+func (c *MachineConfig) freezeDisk() (string, error) {
+	cacheDir, err := CacheDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(cacheDir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	disk := filepath.Join(c.Location, c.Image)
+	base := filepath.Join(cacheDir, c.Alias+"-"+strconv.FormatInt(time.Now().Unix(), 10)+".qcow2")
+
+	info, err := os.Stat(disk)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(disk, base); err != nil {
+		return "", err
+	}
+	thaw := func() {
+		os.Remove(disk)
+		os.Remove(base + ".sha256")
+		os.Chmod(base, info.Mode().Perm())
+		os.Rename(base, disk)
+	}
+
+	if err := createOverlay(base, disk); err != nil {
+		thaw()
+		return "", err
+	}
+	if err := SealCacheImage(base); err != nil {
+		thaw()
+		return "", err
+	}
+
+	backing := c.Backing
+	c.Backing = base
+	if err := SaveMachineConfig(*c); err != nil {
+		c.Backing = backing
+		thaw()
+		return "", err
+	}
+
+	log.Println("moved the disk of " + c.Alias + " to " + base + ", which it now shares with its linked clones as their base image")
+	return base, nil
+}
+
+// createOverlay creates a qcow2 image at path backed by base
+func createOverlay(base string, path string) error {
+	out, err := exec.Command("qemu-img", "create", "-f", "qcow2", "-b", base, "-F", "qcow2", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img create: %v: %s", err, out)
+	}
+	return nil
+}
+
+// rekey replaces the host keys, keypair and root password that a clone shares
+// with the instance it was cloned from
+func (c *MachineConfig) rekey() error {
+	if err := c.regenerateHostKeys(); err != nil {
+		return err
+	}
+	if c.SSHPassword == "key::"+sourceKeyFile {
+		if err := c.replaceSourceKey(); err != nil {
+			return err
+		}
+	}
+	return os.Remove(c.rekeyMarker())
+}
@@ -0,0 +1,204 @@
+package qemu
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// consoleIdleTimeout is how long the console broker waits for a client
+// before exiting
+const consoleIdleTimeout = 10 * time.Second
+
+// ConsoleSocket is where the console broker accepts clients
+func (c *MachineConfig) ConsoleSocket() string {
+	return filepath.Join(c.Location, "alpine.console")
+}
+
+// ServeConsole connects to the serial socket of a running instance and shares
+// it with every client of ConsoleSocket. QEMU serves its serial socket to one
+// client at a time, so all consoles go through this broker. It returns when
+// the instance stops or no clients have been attached for a while. A broker
+// started while another one runs returns at once.
+func (c *MachineConfig) ServeConsole() error {
+	// the broker that holds the lock owns the serial socket and ConsoleSocket
+	lock, err := os.OpenFile(c.ConsoleSocket()+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	err = flock(lock, syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	serial, err := net.Dial("unix", filepath.Join(c.Location, "alpine.sock"))
+	if err != nil {
+		return err
+	}
+	defer serial.Close()
+
+	os.Remove(c.ConsoleSocket())
+	ln, err := net.Listen("unix", c.ConsoleSocket())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(c.ConsoleSocket())
+	defer ln.Close()
+
+	var mu sync.Mutex
+	clients := make(map[net.Conn]bool)
+
+	serialClosed := make(chan struct{})
+	go func() {
+		defer close(serialClosed)
+		buf := make([]byte, 4096)
+		for {
+			n, err := serial.Read(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			for client := range clients {
+				// a stuck client must not stall the others
+				client.SetWriteDeadline(time.Now().Add(time.Second))
+				if _, err := client.Write(buf[:n]); err != nil {
+					client.Close()
+					delete(clients, client)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	joined := make(chan net.Conn)
+	go func() {
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			joined <- client
+		}
+	}()
+
+	left := make(chan net.Conn)
+	idle := time.NewTimer(consoleIdleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case client := <-joined:
+			mu.Lock()
+			clients[client] = true
+			mu.Unlock()
+			idle.Stop()
+			go func() {
+				io.Copy(serial, client)
+				left <- client
+			}()
+		case client := <-left:
+			client.Close()
+			mu.Lock()
+			delete(clients, client)
+			remaining := len(clients)
+			mu.Unlock()
+			if remaining == 0 {
+				idle.Reset(consoleIdleTimeout)
+			}
+		case <-idle.C:
+			return nil
+		case <-serialClosed:
+			mu.Lock()
+			for client := range clients {
+				client.Close()
+			}
+			mu.Unlock()
+			return nil
+		}
+	}
+}
+
+// Console attaches the terminal to the console broker in raw mode until the
+// detach sequence is typed or the instance stops
+func (c *MachineConfig) Console(detach []byte, detachName string) error {
+	conn, err := net.Dial("unix", c.ConsoleSocket())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("terminal make raw: %s", err)
+	}
+	defer term.Restore(fd, state)
+
+	fmt.Printf("connected to %s console (type %s to detach)\r\n", c.Alias, detachName)
+
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(os.Stdout, conn)
+		close(closed)
+	}()
+
+	detached := make(chan error, 1)
+	go func() {
+		detached <- forwardUntil(os.Stdin, conn, detach)
+	}()
+
+	select {
+	case err := <-detached:
+		fmt.Print("\r\n")
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	case <-closed:
+		fmt.Print("\r\n")
+		return errors.New("console of " + c.Alias + " closed")
+	}
+}
+
+// forwardUntil copies in to out until the detach sequence is read. Input that
+// partially matches the sequence is held back until it is known not to match.
+func forwardUntil(in io.Reader, out io.Writer, detach []byte) error {
+	buf := make([]byte, 1024)
+	var pending []byte
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			return err
+		}
+
+		var forward []byte
+		for _, b := range buf[:n] {
+			pending = append(pending, b)
+			if bytes.Equal(pending, detach) {
+				return nil
+			}
+			for len(pending) > 0 && !bytes.HasPrefix(detach, pending) {
+				forward = append(forward, pending[0])
+				pending = pending[1:]
+			}
+		}
+		if len(forward) > 0 {
+			if _, err := out.Write(forward); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package qemu
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/beringresearch/macpine/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// discoveryTimeout bounds how long Exec waits for the address of an instance
+// on a host network
+const discoveryTimeout = 2 * time.Minute
+
+// discoveryInterval is the pause between rounds over the address sources
+const discoveryInterval = 2 * time.Second
+
+// discoveryTTL is how long an address found without a lease stays cached
+const discoveryTTL = 10 * time.Minute
+
+// guestAgentTimeout bounds each exchange with the guest agent, which never
+// answers if it is not installed in the guest
+const guestAgentTimeout = 3 * time.Second
+
+// ErrNoAddress is returned by an address source that has not seen the
+// instance
+var ErrNoAddress = errors.New("no address found")
+
+// ErrDiscoveryTimeout is wrapped by a DiscoveryError
+var ErrDiscoveryTimeout = errors.New("timed out discovering instance address")
+
+// DiscoveryError is returned when no source found the address of an instance
+// before the deadline. Errs holds the last error of each source.
+type DiscoveryError struct {
+	Alias string
+	MAC   string
+	Errs  map[string]error
+}
+
+func (e *DiscoveryError) Error() string {
+	var reasons []string
+	for _, source := range addressSources {
+		if err, ok := e.Errs[source.name]; ok {
+			reasons = append(reasons, source.name+": "+err.Error())
+		}
+	}
+	return "unable to find the address of " + e.Alias + " (" + e.MAC + ") in time: " + strings.Join(reasons, "; ")
+}
+
+func (e *DiscoveryError) Unwrap() error {
+	return ErrDiscoveryTimeout
+}
+
+// addressSource finds the address of an instance and how long it stays valid
+type addressSource struct {
+	name string
+	find func(c *MachineConfig, deadline time.Time) (Lease, error)
+}
+
+// addressSources are tried in order until one finds the instance
+var addressSources = []addressSource{
+	{"leases", (*MachineConfig).leaseAddress},
+	{"guest agent", (*MachineConfig).guestAgentAddress},
+	{"rx-filter", (*MachineConfig).rxFilterAddress},
+	{"arp", (*MachineConfig).arpAddress},
+}
+
+// addressCache is the last address found for an instance, stored in
+// alpine.ip until the instance stops or the lease expires
+type addressCache struct {
+	IP      string    `yaml:"ip"`
+	MAC     string    `yaml:"mac"`
+	Expires time.Time `yaml:"expires,omitempty"`
+}
+
+// DiscoverIP returns the address of an instance on a host network, trying
+// DHCP leases, the QEMU guest agent, the MAC address reported by QMP
+// query-rx-filter and the host ARP table until one of them finds it or the
+// deadline passes. Instances on the default network are reached on localhost.
+func (c *MachineConfig) DiscoverIP(deadline time.Time) (string, error) {
+	if !c.HostNetwork() {
+		return "localhost", nil
+	}
+	if ip, ok := c.cachedAddress(); ok {
+		return ip, nil
+	}
+
+	log.Println("discovering the address of " + c.Alias)
+	errs := make(map[string]error)
+	for {
+		for _, source := range addressSources {
+			lease, err := source.find(c, deadline)
+			if err == nil {
+				c.cacheAddress(lease)
+				return lease.IP, nil
+			}
+			errs[source.name] = err
+		}
+
+		if time.Now().Add(discoveryInterval).After(deadline) {
+			return "", &DiscoveryError{Alias: c.Alias, MAC: c.MACAddress, Errs: errs}
+		}
+		time.Sleep(discoveryInterval)
+	}
+}
+
+// KnownIP returns the address of an instance on a host network if it is
+// cached or leased, without waiting for it to be discovered
+func (c *MachineConfig) KnownIP() (string, bool) {
+	if ip, ok := c.cachedAddress(); ok {
+		return ip, true
+	}
+	lease, err := c.leaseAddress(time.Now())
+	if err != nil {
+		return "", false
+	}
+	c.cacheAddress(lease)
+	return lease.IP, true
+}
+
+// GetIPAddressByMac obtains machine IP address from the leases of the DHCP server of its
+// host network. Only applicable to machines on VMNet, a bridge or a tap device
+func (c *MachineConfig) GetIPAddressByMac() (string, error) {
+	lease, err := c.LeaseProvider().Lookup(c.MACAddress)
+	return lease.IP, err
+}
+
+// leaseAddress looks up the instance in the DHCP leases. An expired lease may
+// have been handed to another host since.
+func (c *MachineConfig) leaseAddress(deadline time.Time) (Lease, error) {
+	lease, err := c.LeaseProvider().Lookup(c.MACAddress)
+	if err == nil && !lease.Expires.IsZero() && time.Now().After(lease.Expires) {
+		return Lease{}, ErrNoLease
+	}
+	return lease, err
+}
+
+// guestAgentAddress asks the QEMU guest agent for the IPv4 address of the
+// interface with the MAC address of the instance
+func (c *MachineConfig) guestAgentAddress(deadline time.Time) (Lease, error) {
+	if d := time.Now().Add(guestAgentTimeout); d.Before(deadline) {
+		deadline = d
+	}
+
+	conn, err := net.DialTimeout("unix", filepath.Join(c.Location, "alpine.qga"), time.Until(deadline))
+	if err != nil {
+		return Lease{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	reader := bufio.NewReader(conn)
+
+	// guest-sync discards replies left over from earlier connections
+	id := time.Now().UnixNano() & 0x7fffffff
+	ret, err := guestAgentCommand(conn, reader, "guest-sync", map[string]int64{"id": id})
+	for err == nil && string(ret) != jsonInt(id) {
+		ret, err = guestAgentReply(reader)
+	}
+	if err != nil {
+		return Lease{}, err
+	}
+
+	ret, err = guestAgentCommand(conn, reader, "guest-network-get-interfaces", nil)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	var interfaces []struct {
+		HardwareAddress string `json:"hardware-address"`
+		IPAddresses     []struct {
+			Type    string `json:"ip-address-type"`
+			Address string `json:"ip-address"`
+		} `json:"ip-addresses"`
+	}
+	if err := json.Unmarshal(ret, &interfaces); err != nil {
+		return Lease{}, err
+	}
+	for _, i := range interfaces {
+		if utils.NormalizeMAC(i.HardwareAddress) != utils.NormalizeMAC(c.MACAddress) {
+			continue
+		}
+		for _, addr := range i.IPAddresses {
+			if addr.Type == "ipv4" {
+				return Lease{IP: addr.Address, Expires: time.Now().Add(discoveryTTL)}, nil
+			}
+		}
+	}
+	return Lease{}, ErrNoAddress
+}
+
+// rxFilterAddress looks up the MAC address QEMU reports for the guest
+// interface, which differs from the configured one if the guest changed it
+func (c *MachineConfig) rxFilterAddress(deadline time.Time) (Lease, error) {
+	mon, err := c.QMP()
+	if err != nil {
+		return Lease{}, err
+	}
+	defer mon.Close()
+
+	ret, err := mon.ExecuteTimeout("query-rx-filter", map[string]string{"name": "net0"}, time.Until(deadline))
+	if err != nil {
+		return Lease{}, err
+	}
+	var filters []struct {
+		MainMAC string `json:"main-mac"`
+	}
+	if err := json.Unmarshal(ret, &filters); err != nil {
+		return Lease{}, err
+	}
+	if len(filters) == 0 || utils.NormalizeMAC(filters[0].MainMAC) == utils.NormalizeMAC(c.MACAddress) {
+		return Lease{}, ErrNoAddress
+	}
+
+	mac := filters[0].MainMAC
+	if lease, err := c.LeaseProvider().Lookup(mac); err == nil {
+		return lease, nil
+	}
+	ip, err := arpLookup(mac)
+	if err != nil {
+		return Lease{}, err
+	}
+	return Lease{IP: ip, Expires: time.Now().Add(discoveryTTL)}, nil
+}
+
+func (c *MachineConfig) arpAddress(deadline time.Time) (Lease, error) {
+	ip, err := arpLookup(c.MACAddress)
+	if err != nil {
+		return Lease{}, err
+	}
+	return Lease{IP: ip, Expires: time.Now().Add(discoveryTTL)}, nil
+}
+
+// arpLookup finds mac in the ARP table of the host
+func arpLookup(mac string) (string, error) {
+	mac = utils.NormalizeMAC(mac)
+
+	if runtime.GOOS == "linux" {
+		content, err := os.ReadFile("/proc/net/arp")
+		if err != nil {
+			return "", err
+		}
+		// IP address, HW type, Flags, HW address, Mask, Device
+		for _, line := range strings.Split(string(content), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && utils.NormalizeMAC(fields[3]) == mac {
+				return fields[0], nil
+			}
+		}
+		return "", ErrNoAddress
+	}
+
+	out, err := exec.Command("arp", "-an").Output()
+	if err != nil {
+		return "", err
+	}
+	// ? (192.168.64.5) at 56:ab:1:2:3:4 on bridge100 ifscope [ethernet]
+	entry := regexp.MustCompile(`\(([0-9.]+)\) at ([0-9a-fA-F:]+)`)
+	for _, m := range entry.FindAllStringSubmatch(string(out), -1) {
+		if utils.NormalizeMAC(m[2]) == mac {
+			return m[1], nil
+		}
+	}
+	return "", ErrNoAddress
+}
+
+// guestAgentCommand sends a command to the guest agent and reads its reply
+func guestAgentCommand(conn net.Conn, reader *bufio.Reader, cmd string, args interface{}) (json.RawMessage, error) {
+	payload, err := json.Marshal(map[string]interface{}{"execute": cmd, "arguments": args})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(payload, '\n')); err != nil {
+		return nil, err
+	}
+	return guestAgentReply(reader)
+}
+
+// guestAgentReply reads the next reply of the guest agent
+func guestAgentReply(reader *bufio.Reader) (json.RawMessage, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var reply struct {
+		Return json.RawMessage `json:"return"`
+		Error  *struct {
+			Desc string `json:"desc"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(line, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != nil {
+		return nil, errors.New("guest agent: " + reply.Error.Desc)
+	}
+	return reply.Return, nil
+}
+
+func jsonInt(n int64) string {
+	b, _ := json.Marshal(n)
+	return string(b)
+}
+
+// cachedAddress returns the cached address of the instance unless it has
+// expired or belongs to another MAC address
+func (c *MachineConfig) cachedAddress() (string, bool) {
+	content, err := os.ReadFile(filepath.Join(c.Location, "alpine.ip"))
+	if err != nil {
+		return "", false
+	}
+	var cache addressCache
+	if err := yaml.Unmarshal(content, &cache); err != nil {
+		return "", false
+	}
+	if cache.IP == "" || cache.MAC != c.MACAddress {
+		return "", false
+	}
+	if !cache.Expires.IsZero() && time.Now().After(cache.Expires) {
+		return "", false
+	}
+	return cache.IP, true
+}
+
+// cacheAddress records the address found for the instance
+func (c *MachineConfig) cacheAddress(lease Lease) {
+	content, err := yaml.Marshal(&addressCache{IP: lease.IP, MAC: c.MACAddress, Expires: lease.Expires})
+	if err != nil {
+		return
+	}
+	utils.WriteFileAtomic(filepath.Join(c.Location, "alpine.ip"), content, 0644)
+}
@@ -0,0 +1,230 @@
+package qemu
+
+import (
+	"errors"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/beringresearch/macpine/utils"
+)
+
+// defaultSlirpNet is the guest network of the QEMU user network when the
+// instance sets none
+const defaultSlirpNet = "10.0.2.0/24"
+
+// hostResolvConf lists the resolvers of the host
+const hostResolvConf = "/etc/resolv.conf"
+
+// domainFormat matches a domain name of letters, digits and hyphens, which is
+// all that is safe to quote into the guest configuration
+var domainFormat = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.?$`)
+
+// CheckNetworkSettings validates the DNS and user network settings
+func (c *MachineConfig) CheckNetworkSettings() error {
+	for _, dns := range c.DNS {
+		if net.ParseIP(dns) == nil {
+			return errors.New("invalid DNS server " + dns)
+		}
+	}
+	for _, domain := range c.Search {
+		if len(domain) > 253 || !domainFormat.MatchString(domain) {
+			return errors.New("invalid search domain " + domain)
+		}
+	}
+
+	if c.SlirpNet == "" && c.SlirpDNS == "" && c.SlirpDHCPStart == "" {
+		return nil
+	}
+	if c.HostNetwork() {
+		return errors.New("slirp settings only apply to the default user network")
+	}
+
+	_, subnet, err := net.ParseCIDR(c.slirpNet())
+	if err != nil || subnet.IP.To4() == nil {
+		return errors.New("invalid slirp network " + c.SlirpNet + ", use IPv4 CIDR notation such as 10.0.2.0/24")
+	}
+	for _, addr := range []string{c.SlirpDNS, c.SlirpDHCPStart} {
+		if addr == "" {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return errors.New("invalid slirp address " + addr)
+		}
+		if !subnet.Contains(ip) {
+			return errors.New(addr + " is outside the slirp network " + subnet.String())
+		}
+	}
+	return nil
+}
+
+// hasDNSSettings reports whether the instance sets its own DNS servers or
+// search domains rather than following the host
+func (c *MachineConfig) hasDNSSettings() bool {
+	return len(c.DNS) > 0 || len(c.Search) > 0
+}
+
+// slirpArgs returns the user network options that place the guest network
+func (c *MachineConfig) slirpArgs() string {
+	var args string
+	if c.SlirpNet != "" {
+		args += ",net=" + c.SlirpNet
+	}
+	if c.SlirpDNS != "" {
+		args += ",dns=" + c.SlirpDNS
+	}
+	if c.SlirpDHCPStart != "" {
+		args += ",dhcpstart=" + c.SlirpDHCPStart
+	}
+	return args
+}
+
+func (c *MachineConfig) slirpNet() string {
+	if c.SlirpNet != "" {
+		return c.SlirpNet
+	}
+	return defaultSlirpNet
+}
+
+// slirpDNS returns the address of the DNS forwarder of the user network,
+// which relays guest queries to the host resolvers
+func (c *MachineConfig) slirpDNS() string {
+	if c.SlirpDNS != "" {
+		return c.SlirpDNS
+	}
+	_, subnet, err := net.ParseCIDR(c.slirpNet())
+	if err != nil || subnet.IP.To4() == nil {
+		return "10.0.2.3"
+	}
+	ip := subnet.IP.To4()
+	return net.IPv4(ip[0], ip[1], ip[2], ip[3]+3).String()
+}
+
+// SlirpHost returns the address at which a guest on the user network reaches
+// the host, and so the ports forwarded to other instances
+func (c *MachineConfig) SlirpHost() string {
+	_, subnet, err := net.ParseCIDR(c.slirpNet())
+	if err != nil || subnet.IP.To4() == nil {
+		return "10.0.2.2"
+	}
+	ip := subnet.IP.To4()
+	return net.IPv4(ip[0], ip[1], ip[2], ip[3]+2).String()
+}
+
+// Resolvers returns the DNS servers of the guest. Unless the instance sets
+// its own, these are the resolvers of the host. Resolvers on the host
+// loopback are reached through the DNS forwarder of the user network, and
+// cannot be used on host networks.
+func (c *MachineConfig) Resolvers() []string {
+	if len(c.DNS) > 0 {
+		return c.DNS
+	}
+
+	var servers []string
+	hostServers, _ := readResolvConf()
+	for _, server := range hostServers {
+		ip := net.ParseIP(server)
+		if ip == nil {
+			continue
+		}
+		if ip.IsLoopback() {
+			if c.HostNetwork() {
+				continue
+			}
+			server = c.slirpDNS()
+		}
+		if !utils.StringSliceContains(servers, server) {
+			servers = append(servers, server)
+		}
+	}
+
+	if len(servers) == 0 && !c.HostNetwork() {
+		servers = []string{c.slirpDNS()}
+	}
+	return servers
+}
+
+// SearchDomains returns the DNS search domains of the guest, by default
+// those of the host
+func (c *MachineConfig) SearchDomains() []string {
+	if len(c.Search) > 0 {
+		return c.Search
+	}
+	_, search := readResolvConf()
+
+	// the host file is not checked like instance settings are
+	var valid []string
+	for _, domain := range search {
+		if domainFormat.MatchString(domain) {
+			valid = append(valid, domain)
+		}
+	}
+	return valid
+}
+
+// configureDNS writes the resolvers and search domains to the guest, both to
+// /etc/resolv.conf and to dhclient.conf so that lease renewals keep them
+func (c *MachineConfig) configureDNS() error {
+	servers := c.Resolvers()
+	search := c.SearchDomains()
+
+	var resolvConf, dhclientConf []string
+	if len(search) > 0 {
+		resolvConf = append(resolvConf, "search "+strings.Join(search, " "))
+		dhclientConf = append(dhclientConf, "supersede domain-search \""+strings.Join(search, "\", \"")+"\";")
+	}
+	for _, server := range servers {
+		resolvConf = append(resolvConf, "nameserver "+server)
+	}
+	if len(servers) > 0 {
+		dhclientConf = append(dhclientConf, "supersede domain-name-servers "+strings.Join(servers, ", ")+";")
+	}
+
+	cmds := []string{"mkdir -p /etc/dhcp"}
+	// without servers, the guest keeps those handed out by DHCP
+	if len(servers) > 0 {
+		cmds = append(cmds, "printf '%s\\n' '"+strings.Join(resolvConf, "' '")+"' > /etc/resolv.conf")
+	}
+	// the here-document comes last, as its terminator must be alone on its line
+	cmds = append(cmds, `cat >/etc/dhcp/dhclient.conf <<EOL
+option rfc3442-classless-static-routes code 121 = array of unsigned integer 8;
+
+send host-name = gethostname();
+request subnet-mask, broadcast-address, time-offset, routers,
+        domain-name, domain-name-servers, domain-search, host-name,
+        dhcp6.name-servers, dhcp6.domain-search, dhcp6.fqdn, dhcp6.sntp-servers,
+        netbios-name-servers, netbios-scope, interface-mtu,
+        rfc3442-classless-static-routes, ntp-servers;
+
+`+strings.Join(dhclientConf, "\n")+`
+EOL`)
+
+	_, err := c.Exec(strings.Join(cmds, " && "), true)
+	return err
+}
+
+// readResolvConf returns the name servers and search domains of the host
+func readResolvConf() ([]string, []string) {
+	content, err := os.ReadFile(hostResolvConf)
+	if err != nil {
+		return nil, nil
+	}
+
+	var servers, search []string
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			servers = append(servers, fields[1])
+		case "search", "domain":
+			// the last search or domain line wins
+			search = fields[1:]
+		}
+	}
+	return servers, search
+}
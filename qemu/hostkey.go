@@ -0,0 +1,104 @@
+package qemu
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyAlias names the instance in its own known_hosts file. It does not
+// depend on the alias, address or port, which all change over the life of an
+// instance, so a rename or a new lease does not reset the recorded key.
+const HostKeyAlias = "macpine"
+
+// ErrHostKeyChanged is wrapped by a HostKeyError
+var ErrHostKeyChanged = errors.New("host key changed")
+
+// HostKeyError is returned when an instance presents a host key other than
+// the one recorded on first connect
+type HostKeyError struct {
+	Alias string
+	File  string
+}
+
+func (e *HostKeyError) Error() string {
+	return "host key of " + e.Alias + " does not match the one recorded in " + e.File +
+		"; if the instance was rebuilt, run: alpine ssh --reset-host-key " + e.Alias
+}
+
+func (e *HostKeyError) Unwrap() error {
+	return ErrHostKeyChanged
+}
+
+// KnownHostsFile is where the host key of the instance is recorded
+func (c *MachineConfig) KnownHostsFile() string {
+	return filepath.Join(c.Location, "known_hosts")
+}
+
+// ResetHostKey forgets the recorded host key, so that the next connection
+// records whatever key the instance presents
+func (c *MachineConfig) ResetHostKey() error {
+	err := os.Remove(c.KnownHostsFile())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// hostKeyCallback verifies the key of the instance against its known_hosts
+// file, trusting and recording the key presented on first use
+func (c *MachineConfig) hostKeyCallback() ssh.HostKeyCallback {
+	return func(_ string, remote net.Addr, key ssh.PublicKey) error {
+		file := c.KnownHostsFile()
+		if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+			return c.recordHostKey(key)
+		}
+
+		check, err := knownhosts.New(file)
+		if err != nil {
+			return err
+		}
+		err = check(HostKeyAlias+":22", remote, key)
+
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			if len(keyErr.Want) == 0 {
+				return c.recordHostKey(key)
+			}
+			return &HostKeyError{Alias: c.Alias, File: file}
+		}
+		return err
+	}
+}
+
+func (c *MachineConfig) recordHostKey(key ssh.PublicKey) error {
+	f, err := os.OpenFile(c.KnownHostsFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(knownhosts.Line([]string{HostKeyAlias}, key) + "\n")
+	return err
+}
+
+// rekeyMarker records that the guest still carries the keys of the instance
+// it was cloned from, which it replaces on its first start
+func (c *MachineConfig) rekeyMarker() string {
+	return filepath.Join(c.Location, "alpine.rekey")
+}
+
+// regenerateHostKeys replaces the host keys of the guest and forgets the one
+// recorded for it, so that a clone does not share its identity with the
+// instance it was cloned from
+func (c *MachineConfig) regenerateHostKeys() error {
+	_, err := c.Exec("rm -f /etc/ssh/ssh_host_* && ssh-keygen -A && rc-service sshd restart", true)
+	if err != nil {
+		return err
+	}
+	return c.ResetHostKey()
+}
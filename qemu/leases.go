@@ -0,0 +1,123 @@
+package qemu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beringresearch/macpine/utils"
+)
+
+// ErrNoLease is returned when a DHCP server has not leased an address to an
+// instance yet
+var ErrNoLease = fmt.Errorf("%w in the dhcp leases", ErrNoAddress)
+
+// bootpdLeasesPath is where the macOS DHCP server used by vmnet records leases
+const bootpdLeasesPath = "/var/db/dhcpd_leases"
+
+// dnsmasqLeasesPaths are the usual dnsmasq lease files of Linux distributions
+var dnsmasqLeasesPaths = []string{
+	"/var/lib/misc/dnsmasq.leases",
+	"/var/lib/dnsmasq/dnsmasq.leases",
+}
+
+// Lease is an address leased by a DHCP server. A zero Expires means the
+// lease does not expire.
+type Lease struct {
+	IP      string
+	Expires time.Time
+}
+
+// LeaseProvider finds the address a DHCP server leased to a MAC address
+type LeaseProvider interface {
+	Lookup(mac string) (Lease, error)
+}
+
+// BootpdLeases reads the leases of the macOS bootpd DHCP server
+type BootpdLeases struct {
+	Path string
+}
+
+// Lookup returns the address leased to mac
+func (l BootpdLeases) Lookup(mac string) (Lease, error) {
+	content, err := os.ReadFile(l.Path)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	result := utils.ParseDhcpLeasesFile(string(content))
+	dhcpData := utils.ConvertStringArrayToDhcpDataArray(result)
+	dhcpConfig := utils.MatchHwAddress(dhcpData, mac)
+	if dhcpConfig == nil {
+		return Lease{}, ErrNoLease
+	}
+
+	// bootpd records the expiry as a hexadecimal unix time
+	lease := Lease{IP: dhcpConfig.IpAddress}
+	if expires, err := strconv.ParseInt(strings.TrimPrefix(dhcpConfig.Lease, "0x"), 16, 64); err == nil {
+		lease.Expires = time.Unix(expires, 0)
+	}
+	return lease, nil
+}
+
+// DnsmasqLeases reads the leases of a dnsmasq DHCP server
+type DnsmasqLeases struct {
+	Path string
+}
+
+// Lookup returns the address leased to mac
+func (l DnsmasqLeases) Lookup(mac string) (Lease, error) {
+	if l.Path == "" {
+		return Lease{}, errors.New("no dnsmasq lease file found, set leases in config.yaml")
+	}
+	content, err := os.ReadFile(l.Path)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	dhcpConfig := utils.MatchHwAddress(utils.ParseDnsmasqLeasesFile(string(content)), mac)
+	if dhcpConfig == nil {
+		return Lease{}, ErrNoLease
+	}
+
+	// dnsmasq records the expiry as a decimal unix time, or 0 for leases
+	// that never expire
+	lease := Lease{IP: dhcpConfig.IpAddress}
+	if expires, err := strconv.ParseInt(dhcpConfig.Lease, 10, 64); err == nil && expires > 0 {
+		lease.Expires = time.Unix(expires, 0)
+	}
+	return lease, nil
+}
+
+// LeaseProvider returns the leases of the DHCP server that serves the host
+// network of the instance: bootpd for vmnet, and dnsmasq for Linux bridges and
+// tap devices. The leases setting overrides the location of the lease file.
+func (c *MachineConfig) LeaseProvider() LeaseProvider {
+	if c.VMNet {
+		path := bootpdLeasesPath
+		if c.Leases != "" {
+			path = c.Leases
+		}
+		return BootpdLeases{Path: path}
+	}
+
+	if c.Leases != "" {
+		return DnsmasqLeases{Path: c.Leases}
+	}
+	for _, path := range dnsmasqLeasesPaths {
+		if _, err := os.Stat(path); err == nil {
+			return DnsmasqLeases{Path: path}
+		}
+	}
+	return DnsmasqLeases{}
+}
+
+// HostNetwork reports whether the instance is attached to a network of the
+// host, through vmnet, a bridge or a tap device, and so is reached on its own
+// address rather than through forwarded ports
+func (c *MachineConfig) HostNetwork() bool {
+	return c.VMNet || c.Bridge != "" || c.Tap != ""
+}
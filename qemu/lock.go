@@ -0,0 +1,99 @@
+package qemu
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrBusy is returned when another process holds the lock of an instance
+var ErrBusy = errors.New("instance busy")
+
+// InstanceLock is the advisory lock held by an operation that changes an
+// instance, such as start, publish or rename
+type InstanceLock struct {
+	file *os.File
+}
+
+// LockInstance takes the lock of instance vmName for op. If another process
+// holds it, LockInstance fails with ErrBusy, or waits for it to be released
+// when wait is set. The lock is taken before the instance configuration is
+// read, so that the operation never works on a stale copy.
+func LockInstance(vmName string, op string, wait bool) (*InstanceLock, error) {
+	userHomeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(userHomeDir, ".macpine", vmName, "alpine.lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = flock(f, syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		holder := lockHolder(f)
+		if !wait {
+			f.Close()
+			if holder == "" {
+				return nil, ErrBusy
+			}
+			return nil, fmt.Errorf("%w: %s", ErrBusy, holder)
+		}
+		if holder == "" {
+			holder = "another operation"
+		}
+		log.Println(vmName + " is busy, waiting for " + holder + " to finish")
+		err = flock(f, syscall.LOCK_EX)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// record the holder for processes that find the instance busy
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+" "+op+"\n"), 0)
+	}
+
+	return &InstanceLock{file: f}, nil
+}
+
+// Unlock releases the lock
+func (l *InstanceLock) Unlock() {
+	if l == nil || l.file == nil {
+		return
+	}
+	l.file.Truncate(0)
+	flock(l.file, syscall.LOCK_UN)
+	l.file.Close()
+	l.file = nil
+}
+
+// lockHolder describes the operation holding the lock file f, such as
+// "publish by pid 123", or returns "" if it has not been recorded yet
+func lockHolder(f *os.File) string {
+	buf := make([]byte, 256)
+	n, _ := f.ReadAt(buf, 0)
+
+	pid, op, found := strings.Cut(strings.TrimSpace(string(buf[:n])), " ")
+	if !found {
+		return ""
+	}
+	return op + " by pid " + pid
+}
+
+// flock retries flock(2) when it is interrupted by a signal
+func flock(f *os.File, how int) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if !errors.Is(err, syscall.EINTR) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package qemu
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/beringresearch/macpine/utils"
+)
+
+const (
+	// logMaxSize is the size at which the serial log is rotated
+	logMaxSize = 10 * 1000 * 1000
+	// logKeep is how many rotated logs are kept
+	logKeep = 3
+	// bootMarker starts the line written to the serial log on every boot
+	bootMarker = "[macpine] "
+)
+
+// SerialLog is the file QEMU copies guest serial output to
+func (c *MachineConfig) SerialLog() string {
+	return filepath.Join(c.Location, "alpine.log")
+}
+
+// QEMULog is the file QEMU's output is captured in until it daemonizes
+func (c *MachineConfig) QEMULog() string {
+	return filepath.Join(c.Location, "qemu.log")
+}
+
+// DebugLog is the file QEMU writes its diagnostics to once it has daemonized,
+// given to it with -D
+func (c *MachineConfig) DebugLog() string {
+	return filepath.Join(c.Location, "qemu.debug.log")
+}
+
+// openLogs rotates the instance logs, marks the start of a boot in the serial
+// log and returns the QEMU log opened for appending. QEMU truncates its debug
+// log as it opens it, so the one of the previous boot is always moved aside.
+func (c *MachineConfig) openLogs() (*os.File, error) {
+	if err := utils.RotateLog(c.SerialLog(), logMaxSize, logKeep); err != nil {
+		return nil, err
+	}
+	if err := utils.RotateLog(c.QEMULog(), logMaxSize, logKeep); err != nil {
+		return nil, err
+	}
+	if err := utils.ArchiveLog(c.DebugLog(), logKeep); err != nil {
+		return nil, err
+	}
+
+	serial, err := os.OpenFile(c.SerialLog(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	_, err = serial.WriteString(bootMarker + time.Now().UTC().Format(time.RFC3339) + " booting " + c.Alias + "\n")
+	serial.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(c.QEMULog(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// RotateRunningLogs rotates the logs of a running instance once they grow past
+// logMaxSize. QEMU appends to the serial log, which is copied aside and
+// truncated, while the debug log is moved aside and QEMU told to reopen it.
+func (c *MachineConfig) RotateRunningLogs() error {
+	if err := utils.TruncateLog(c.SerialLog(), logMaxSize, logKeep); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(c.DebugLog())
+	if err != nil || info.Size() < logMaxSize {
+		return nil
+	}
+	if err := utils.ArchiveLog(c.DebugLog(), logKeep); err != nil {
+		return err
+	}
+	mon, err := c.QMP()
+	if err != nil {
+		return err
+	}
+	defer mon.Close()
+	_, err = mon.ExecuteTimeout("human-monitor-command", map[string]string{"command-line": "logfile " + c.DebugLog()}, qmpTimeout)
+	return err
+}
+
+// LinesSince drops log lines from before since. QEMU log lines carry their own
+// timestamps, and a line without one is taken to belong to the line before
+// it. Serial output has none, so serial lines are kept from the boot that was
+// running at since onwards.
+func LinesSince(lines []string, since time.Time, serial bool) []string {
+	if serial {
+		start := 0
+		for i, line := range lines {
+			if !strings.HasPrefix(line, bootMarker) {
+				continue
+			}
+			fields := strings.Fields(strings.TrimPrefix(line, bootMarker))
+			if len(fields) == 0 {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, fields[0])
+			if err == nil && !t.After(since) {
+				start = i
+			}
+		}
+		return lines[start:]
+	}
+
+	for i, line := range lines {
+		stamp, _, _ := strings.Cut(line, " ")
+		t, err := time.Parse(time.RFC3339, stamp)
+		if err == nil && !t.Before(since) {
+			return lines[i:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package qemu
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/beringresearch/macpine/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// Network is a private network between instances. Instances attach to it
+// through a switch process that forwards ethernet frames between them, so
+// networks work the same on every host and need no privileges.
+type Network struct {
+	Name   string `yaml:"name"`
+	Subnet string `yaml:"subnet,omitempty"` // used to validate and complete static addresses
+}
+
+// NIC is an additional network interface of an instance
+type NIC struct {
+	Network    string `yaml:"network"`
+	MACAddress string `yaml:"macaddress"`
+	IP         string `yaml:"ip,omitempty"` // static address assigned in the guest, in CIDR notation
+}
+
+// NetworksDir returns the directory holding network definitions and switch sockets
+func NetworksDir() (string, error) {
+	userHomeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(userHomeDir, ".macpine", "networks"), nil
+}
+
+// SwitchSocket is where the switch of the network accepts instances
+func (n *Network) SwitchSocket() (string, error) {
+	dir, err := NetworksDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, n.Name+".sock"), nil
+}
+
+// GetNetwork reads the definition of a network
+func GetNetwork(name string) (Network, error) {
+	network := Network{}
+
+	dir, err := NetworksDir()
+	if err != nil {
+		return network, err
+	}
+
+	config, err := os.ReadFile(filepath.Join(dir, name+".yaml"))
+	if errors.Is(err, os.ErrNotExist) {
+		return network, errors.New("unknown network " + name)
+	}
+	if err != nil {
+		return network, err
+	}
+
+	err = yaml.Unmarshal(config, &network)
+	return network, err
+}
+
+// ListNetworks returns every defined network
+func ListNetworks() ([]Network, error) {
+	dir, err := NetworksDir()
+	if err != nil {
+		return nil, err
+	}
+
+	dirList, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	var networks []Network
+	for _, f := range dirList {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".yaml") {
+			continue
+		}
+		network, err := GetNetwork(strings.TrimSuffix(f.Name(), ".yaml"))
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// CreateNetwork defines a new network
+func CreateNetwork(network Network) error {
+	if _, err := GetNetwork(network.Name); err == nil {
+		return errors.New("network " + network.Name + " already exists")
+	}
+	if network.Subnet != "" {
+		if _, _, err := net.ParseCIDR(network.Subnet); err != nil {
+			return errors.New("invalid subnet " + network.Subnet + ", use CIDR notation such as 10.10.0.0/24")
+		}
+	}
+
+	dir, err := NetworksDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	config, err := yaml.Marshal(&network)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(filepath.Join(dir, network.Name+".yaml"), config, 0644)
+}
+
+// DeleteNetwork removes the definition of a network
+func DeleteNetwork(name string) error {
+	dir, err := NetworksDir()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(dir, name+".yaml"))
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("unknown network " + name)
+	}
+	return err
+}
+
+// GetNIC returns the interface of the instance on a network, or nil
+func (c *MachineConfig) GetNIC(network string) *NIC {
+	for i := range c.NICs {
+		if c.NICs[i].Network == network {
+			return &c.NICs[i]
+		}
+	}
+	return nil
+}
+
+// NewNIC creates an interface on a network with a new MAC address. ip is an
+// optional static address, completed with the prefix length of the network
+// subnet if it has none.
+func NewNIC(name string, ip string) (NIC, error) {
+	nic := NIC{Network: name}
+
+	network, err := GetNetwork(name)
+	if err != nil {
+		return nic, err
+	}
+
+	if ip != "" {
+		nic.IP, err = network.staticAddress(ip)
+		if err != nil {
+			return nic, err
+		}
+	}
+
+	nic.MACAddress, err = utils.GenerateMACAddress()
+	return nic, err
+}
+
+// AttachNetwork adds an interface on a network to a stopped instance
+func (c *MachineConfig) AttachNetwork(name string, ip string) error {
+	if _, _, err := c.RequireState("attach networks to", StateStopped); err != nil {
+		return err
+	}
+	if c.GetNIC(name) != nil {
+		return errors.New(c.Alias + " is already attached to " + name)
+	}
+
+	nic, err := NewNIC(name, ip)
+	if err != nil {
+		return err
+	}
+
+	c.NICs = append(c.NICs, nic)
+	return SaveMachineConfig(*c)
+}
+
+// DetachNetwork removes the interface on a network from a stopped instance
+func (c *MachineConfig) DetachNetwork(name string) error {
+	if _, _, err := c.RequireState("detach networks from", StateStopped); err != nil {
+		return err
+	}
+
+	for i := range c.NICs {
+		if c.NICs[i].Network == name {
+			c.NICs = append(c.NICs[:i], c.NICs[i+1:]...)
+			return SaveMachineConfig(*c)
+		}
+	}
+	return errors.New(c.Alias + " is not attached to " + name)
+}
+
+// staticAddress validates a static address for the network and returns it in
+// CIDR notation
+func (n *Network) staticAddress(ip string) (string, error) {
+	addr, _, err := net.ParseCIDR(ip)
+	if err != nil {
+		addr = net.ParseIP(ip)
+		if addr == nil {
+			return "", errors.New("invalid address " + ip)
+		}
+		prefix := "24"
+		if addr.To4() == nil {
+			prefix = "64"
+		}
+		if n.Subnet != "" {
+			_, subnet, _ := net.ParseCIDR(n.Subnet)
+			ones, _ := subnet.Mask.Size()
+			prefix = strconv.Itoa(ones)
+		}
+		ip = ip + "/" + prefix
+	}
+
+	if n.Subnet != "" {
+		_, subnet, _ := net.ParseCIDR(n.Subnet)
+		if !subnet.Contains(addr) {
+			return "", errors.New(addr.String() + " is outside the subnet " + n.Subnet + " of " + n.Name)
+		}
+	}
+	return ip, nil
+}
+
+// nicArgs returns the QEMU arguments that connect the instance interfaces to
+// the switches of their networks
+func (c *MachineConfig) nicArgs() ([]string, error) {
+	var args []string
+	for i, nic := range c.NICs {
+		network, err := GetNetwork(nic.Network)
+		if err != nil {
+			return nil, err
+		}
+		socket, err := network.SwitchSocket()
+		if err != nil {
+			return nil, err
+		}
+
+		id := "nic" + strconv.Itoa(i+1)
+		args = append(args,
+			"-netdev", "stream,id="+id+",server=off,addr.type=unix,addr.path="+socket,
+			"-device", "virtio-net-pci,netdev="+id+",mac="+nic.MACAddress)
+	}
+	return args, nil
+}
+
+// configureNICs assigns the static addresses of the instance interfaces in
+// the guest, finding each interface by its MAC address
+func (c *MachineConfig) configureNICs() error {
+	var cmds []string
+	for _, nic := range c.NICs {
+		if nic.IP == "" {
+			continue
+		}
+		cmds = append(cmds, "for i in /sys/class/net/*; do "+
+			"if [ \"$(cat $i/address)\" = \""+strings.ToLower(nic.MACAddress)+"\" ]; then "+
+			"ip link set dev ${i##*/} up && ip addr replace "+nic.IP+" dev ${i##*/}; fi; done")
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	_, err := c.Exec(strings.Join(cmds, "; "), true)
+	return err
+}
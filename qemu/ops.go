@@ -2,8 +2,10 @@ package qemu
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -12,9 +14,11 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/beringresearch/macpine/qmp"
 	"github.com/beringresearch/macpine/utils"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -23,66 +27,164 @@ import (
 )
 
 type MachineConfig struct {
-	Alias        string   `yaml:"alias"`
-	Image        string   `yaml:"image"`
-	Arch         string   `yaml:"arch"`
-	CPU          string   `yaml:"cpu"`
-	Memory       string   `yaml:"memory"`
-	Disk         string   `yaml:"disk"`
-	Mount        string   `yaml:"mount"`
-	MachineIP    string   `yaml:"machineip"`
-	Port         string   `yaml:"port"`
-	VMNet        bool     `yaml:"vmnet"`
-	SSHPort      string   `yaml:"sshport"`
-	SSHUser      string   `yaml:"sshuser"`
-	SSHPassword  string   `yaml:"sshpassword"`
-	RootPassword *string  `yaml:"rootpassword,omitempty"`
-	MACAddress   string   `yaml:"macaddress"`
-	Location     string   `yaml:"location"`
-	Tags         []string `yaml:"tags"`
-}
-
-// Exec starts an interactive shell terminal in VM
+	Alias          string     `yaml:"alias"`
+	Image          string     `yaml:"image"`
+	Arch           string     `yaml:"arch"`
+	CPU            string     `yaml:"cpu"`
+	Memory         string     `yaml:"memory"`
+	Disk           string     `yaml:"disk"`
+	Mount          string     `yaml:"mount"`
+	MachineIP      string     `yaml:"machineip"`
+	Port           string     `yaml:"port"`
+	VMNet          bool       `yaml:"vmnet"`
+	Bridge         string     `yaml:"bridge,omitempty"`         // Linux bridge joined through qemu-bridge-helper
+	Tap            string     `yaml:"tap,omitempty"`            // existing tap device
+	Leases         string     `yaml:"leases,omitempty"`         // DHCP lease file of the host network
+	Hosts          bool       `yaml:"hosts,omitempty"`          // keep the names of running instances in /etc/hosts of the guest
+	DNS            []string   `yaml:"dns,omitempty"`            // DNS servers of the guest, defaults to the host resolvers
+	Search         []string   `yaml:"search,omitempty"`         // DNS search domains of the guest, defaults to those of the host
+	SlirpNet       string     `yaml:"slirpnet,omitempty"`       // guest network of the user network, defaults to 10.0.2.0/24
+	SlirpDNS       string     `yaml:"slirpdns,omitempty"`       // address of the user network DNS forwarder
+	SlirpDHCPStart string     `yaml:"slirpdhcpstart,omitempty"` // first address handed out by the user network DHCP server
+	HTTPProxy      string     `yaml:"httpproxy,omitempty"`      // proxy of the guest for http, defaults to that of the host
+	HTTPSProxy     string     `yaml:"httpsproxy,omitempty"`     // proxy of the guest for https, defaults to that of the host
+	NoProxy        string     `yaml:"noproxy,omitempty"`        // hosts reached without the proxy, defaults to those of the host
+	CABundle       string     `yaml:"cabundle,omitempty"`       // PEM certificates on the host for the guest to trust, such as those of an intercepting proxy
+	SSHPort        string     `yaml:"sshport"`
+	SSHUser        string     `yaml:"sshuser"`
+	SSHPassword    string     `yaml:"sshpassword"`
+	RootPassword   *string    `yaml:"rootpassword,omitempty"`
+	MACAddress     string     `yaml:"macaddress"`
+	Location       string     `yaml:"location"`
+	Tags           []string   `yaml:"tags"`
+	StopTimeout    int        `yaml:"stoptimeout,omitempty"`
+	Snapshots      []Snapshot `yaml:"snapshots,omitempty"`
+	Backing        string     `yaml:"backing,omitempty"` // shared base image the disk is an overlay of
+	NICs           []NIC      `yaml:"nics,omitempty"`    // interfaces on private networks
+}
+
+// DefaultStopTimeout is how long a guest is given to power down when
+// MachineConfig.StopTimeout is unset
+const DefaultStopTimeout = 30 * time.Second
+
+// qmpTimeout bounds connecting to and waiting on the QMP socket
+const qmpTimeout = 5 * time.Second
+
+// Exec runs cmd in the VM and returns its standard output. A command that
+// exits non-zero returns an *ssh.ExitError, wrapped with its standard error.
+// The shells ash and bash are attached to the terminal instead.
 func (c *MachineConfig) Exec(cmd string, root bool) (string, error) {
 	if cmd == "" {
 		return "", nil
 	}
-	ip := c.MachineIP
 
-	if c.VMNet {
-		if ip == "localhost" || ip == "" {
-			log.Println("getting instance IP address from DHCP leases")
-			for {
-				dhcpLeasesContent, err := os.ReadFile("/var/db/dhcpd_leases")
-				if err != nil {
-					return "", err
-				}
-				lip, _ := c.GetIPAddressByMac(dhcpLeasesContent)
-				//ip = c.GetIPAddressFromMachine()
-				if lip != "" {
-					c.MachineIP = lip
-					break
-				}
-				fmt.Print(".")
-				time.Sleep(4 * time.Second)
-			}
+	var stdoutBuf bytes.Buffer
+	var stderrBuf bytes.Buffer
 
-			config, err := yaml.Marshal(&c)
+	err := c.ExecStream(cmd, root, nil, &stdoutBuf, &stderrBuf)
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) && stderrBuf.Len() > 0 {
+		return stdoutBuf.String(), fmt.Errorf("%w: %s", err, strings.TrimSpace(stderrBuf.String()))
+	}
+	return stdoutBuf.String(), err
+}
 
-			if err != nil {
-				c.Stop()
-				c.CleanPIDFile()
-				return "", err
-			}
+// ExecStream runs cmd in the VM once, copying stdin to it and its output to
+// stdout and stderr as it is produced. stdin may be nil. A command that exits
+// non-zero returns an *ssh.ExitError holding its exit status. Only
+// connecting to the VM is retried, never the command itself.
+func (c *MachineConfig) ExecStream(cmd string, root bool, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	if cmd == "" {
+		return nil
+	}
 
-			err = os.WriteFile(filepath.Join(c.Location, "config.yaml"), config, 0644)
-			if err != nil {
-				c.Stop()
-				c.CleanPIDFile()
-				return "", err
-			}
+	conn, err := c.dial(root)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	// XXX get shells from /etc/shells instead?
+	if (cmd == "ash") || (cmd == "bash") {
+		return attachShell(session)
+	}
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	// session.Wait waits for Stdin to be drained, which never happens for a
+	// terminal, so stdin is copied outside of the session
+	var stdinPipe io.WriteCloser
+	if stdin != nil {
+		stdinPipe, err = session.StdinPipe()
+		if err != nil {
+			return err
 		}
+	}
 
+	if err := session.Start(cmd); err != nil {
+		return err
+	}
+	if stdin != nil {
+		go func() {
+			io.Copy(stdinPipe, stdin)
+			stdinPipe.Close()
+		}()
+	}
+	return session.Wait()
+}
+
+// credentials caches resolved credentials for the rest of the command, so that
+// a cmd:: helper runs and a keyring:: lookup prompts once per command rather
+// than once per connection
+var (
+	credentialsMu sync.Mutex
+	credentials   = make(map[string]utils.Credential)
+)
+
+// resolveCredential resolves a credential reference once per command
+func resolveCredential(ref string) (utils.Credential, error) {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+
+	if cred, ok := credentials[ref]; ok {
+		return cred, nil
+	}
+	cred, err := utils.GetCredential(ref)
+	if err != nil {
+		return cred, err
+	}
+	credentials[ref] = cred
+	return cred, nil
+}
+
+// forgetCredential drops a cached credential whose source has changed
+func forgetCredential(ref string) {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	delete(credentials, ref)
+}
+
+// dial connects to the VM over ssh, as root if root is set, retrying while
+// it boots
+func (c *MachineConfig) dial(root bool) (*ssh.Client, error) {
+	if c.HostNetwork() {
+		ip, err := c.DiscoverIP(time.Now().Add(discoveryTimeout))
+		if err != nil {
+			return nil, err
+		}
+		if ip != c.MachineIP {
+			c.MachineIP = ip
+			if err := SaveMachineConfig(*c); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	host := c.MachineIP + ":" + c.SSHPort
@@ -97,20 +199,37 @@ func (c *MachineConfig) Exec(cmd string, root bool) (string, error) {
 			pwd = *c.RootPassword
 		}
 	}
-	cred, err := utils.GetCredential(pwd)
+	// credential files are found relative to the instance directory, like
+	// the keys of key:: credentials
+	if path, ok := strings.CutPrefix(pwd, "file::"); ok {
+		pwd = "file::" + c.KeyPath(path)
+	}
+	cred, err := resolveCredential(pwd)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	var conf *ssh.ClientConfig
 	if cred.CRType == utils.PwdCred {
 		conf = &ssh.ClientConfig{
 			User:            user,
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			HostKeyCallback: c.hostKeyCallback(),
 			Auth: []ssh.AuthMethod{
 				ssh.Password(cred.CR),
 			},
 		}
+	} else if cred.CRType == utils.KeyCred {
+		signer, err := c.keySigner(cred.CR)
+		if err != nil {
+			return nil, err
+		}
+		conf = &ssh.ClientConfig{
+			User: user,
+			Auth: []ssh.AuthMethod{
+				ssh.PublicKeys(signer),
+			},
+			HostKeyCallback: c.hostKeyCallback(),
+		}
 	} else { // utils.HostCred
 		// Use SSH agent (https://pkg.go.dev/golang.org/x/crypto/ssh/agent#example-NewClient)
 		socket := os.Getenv("SSH_AUTH_SOCK")
@@ -124,7 +243,7 @@ func (c *MachineConfig) Exec(cmd string, root bool) (string, error) {
 			Auth: []ssh.AuthMethod{
 				ssh.PublicKeysCallback(agentClient.Signers),
 			},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			HostKeyCallback: c.hostKeyCallback(),
 		}
 	}
 
@@ -135,51 +254,15 @@ func (c *MachineConfig) Exec(cmd string, root bool) (string, error) {
 		if err == nil {
 			break
 		}
-		if i == 10 {
-			return "", err
+		if i == 10 || errors.Is(err, ErrHostKeyChanged) {
+			return nil, err
 		}
 
-		fmt.Print(".")
+		fmt.Fprint(os.Stderr, ".")
 		time.Sleep(4 * time.Second)
 	}
 
-	defer conn.Close()
-
-	session, err := conn.NewSession()
-	if err != nil {
-		return "", err
-	}
-	defer session.Close()
-
-	var stdoutBuf bytes.Buffer
-	var stderrBuf bytes.Buffer
-	var stdinBuf bytes.Buffer
-
-	// XXX get shells from /etc/shells instead?
-	if (cmd == "ash") || (cmd == "bash") {
-		err := attachShell(session)
-		if err != nil {
-			return "", err
-		}
-	} else {
-
-		session.Stdout = &stdoutBuf
-		session.Stderr = &stderrBuf
-		session.Stdin = &stdinBuf
-
-		for i := 0; i < 5; i++ {
-			err := session.Run(cmd)
-			if err == nil {
-				break
-			}
-			if i == 4 {
-				return "", err
-			}
-		}
-	}
-
-	output := stdoutBuf.String()
-	return output, nil
+	return conn, nil
 }
 
 func attachShell(session *ssh.Session) error {
@@ -234,55 +317,177 @@ func attachShell(session *ssh.Session) error {
 	return nil
 }
 
-// Status returns VM status
-func (c *MachineConfig) Status() (string, int) {
-	status := "Stopped"
+// Status returns VM status. A pid file left behind by a QEMU process that is
+// gone, for example after a crash or host reboot, is reported once as
+// "Crashed" and cleaned up. A pid file that cannot be read is reported as
+// "Unknown", and only cleaned up once nothing listens on the QMP socket.
+func (c *MachineConfig) Status() (State, int) {
+	status := StateStopped
 	var pid int
 
+	if c.HasSavedState() {
+		status = StateSaved
+	}
+
 	pidFile := filepath.Join(c.Location, "alpine.pid")
 
 	if _, err := os.Stat(pidFile); err == nil {
-		status = "Running"
-		pid, _ = c.GetInstancePID()
+		pid, err = c.GetInstancePID()
+		if errors.Is(err, os.ErrPermission) {
+			// the runtime files of an instance started with sudo belong to
+			// root, and say nothing about whether it still runs
+			return StateUnknown, 0
+		}
+		if err != nil {
+			// without a pid only the QMP socket can tell whether qemu is
+			// still there, and only a socket nobody listens on proves it
+			// is gone
+			if !c.qmpAbandoned() {
+				return StateUnknown, 0
+			}
+			c.cleanRuntimeFiles()
+			return StateCrashed, 0
+		}
 
-		// check if stopped and return "Paused"
-		execArgs := []string{"-o", "stat=", "-p", strconv.Itoa(pid)}
-		execCmd := "ps"
+		// a QMP answer on the instance's socket proves the process is ours,
+		// otherwise fall back to inspecting the process itself
+		runState, err := c.QueryStatus()
+		if err == nil {
+			return runStateStatus(runState), pid
+		}
+		if !c.isInstanceProcess(pid) {
+			c.cleanRuntimeFiles()
+			return StateCrashed, 0
+		}
 
-		cmd := exec.Command(execCmd, execArgs...)
+		// QMP may be busy with another client
+		status = StateRunning
+	}
 
-		out, _ := cmd.Output()
-		// if err != nil {
-		// 	log.Fatalf("error checking status of qemu process: %v\n", err)
-		// }
-		if strings.TrimSpace(string(out)) == "T" {
-			status = "Paused"
+	return status, pid
+}
+
+// isInstanceProcess reports whether pid is alive and is the QEMU process
+// started for this instance
+func (c *MachineConfig) isInstanceProcess(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// EPERM means the process exists but belongs to another user
+	if err := p.Signal(syscall.Signal(0)); err != nil && !errors.Is(err, syscall.EPERM) {
+		return false
+	}
+
+	out, err := exec.Command("ps", "-ww", "-o", "command=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		// ps exits non-zero for unknown pids; any other failure is inconclusive
+		return !errors.As(err, &exitErr)
+	}
+
+	args := strings.Fields(string(out))
+	if len(args) == 0 || !strings.Contains(filepath.Base(args[0]), "qemu-system") {
+		return false
+	}
+	for i := 1; i < len(args)-1; i++ {
+		if args[i] == "-name" && args[i+1] == c.Alias {
+			return true
 		}
 	}
+	return false
+}
 
-	return status, pid
+// qmpAbandoned reports whether the QMP socket of the instance is missing or
+// refuses connections, which it does not while qemu runs
+func (c *MachineConfig) qmpAbandoned() bool {
+	conn, err := net.DialTimeout("unix", filepath.Join(c.Location, "alpine.qmp"), qmpTimeout)
+	if err == nil {
+		conn.Close()
+		return false
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOENT)
+}
+
+// cleanRuntimeFiles removes the pid file and sockets of a stopped instance
+func (c *MachineConfig) cleanRuntimeFiles() {
+	for _, f := range []string{"alpine.pid", "alpine.sock", "alpine.qmp", "alpine.qga", "alpine.console", "alpine.ip"} {
+		os.Remove(filepath.Join(c.Location, f))
+	}
+}
+
+// QueryStatus returns the raw QEMU run state reported by QMP query-status
+func (c *MachineConfig) QueryStatus() (string, error) {
+	mon, err := c.QMP()
+	if err != nil {
+		return "", err
+	}
+	defer mon.Close()
+
+	ret, err := mon.ExecuteTimeout("query-status", nil, qmpTimeout)
+	if err != nil {
+		return "", err
+	}
+
+	var info struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(ret, &info); err != nil {
+		return "", err
+	}
+	return info.Status, nil
+}
+
+// runStateStatus maps a QEMU RunState onto an instance State
+func runStateStatus(runState string) State {
+	switch runState {
+	case "running":
+		return StateRunning
+	case "prelaunch", "inmigrate", "restore-vm":
+		return StateStarting
+	case "suspended":
+		return StateSuspended
+	case "guest-panicked", "internal-error", "io-error":
+		return StatePanicked
+	case "shutdown":
+		// qemu exits once the guest has shut down
+		return StateStopping
+	default: // paused, debug, postmigrate, save-vm, ...
+		return StatePaused
+	}
 }
 
-// Stop stops an Alpine VM
+// Stop shuts down an Alpine VM. The guest is asked to power down over QMP and
+// given StopTimeout seconds to do so before QEMU is told to quit and, failing
+// that, killed.
 func (c *MachineConfig) Stop() error {
-	// qemu creates PID file with -pidfile flag, and deletes it on sigterm
-	if status, pid := c.Status(); status != "Stopped" {
+	if status, pid := c.Status(); status.Active() || status == StateUnknown {
 		if pid > 0 {
 			p, procErr := os.FindProcess(pid)
 			if procErr != nil {
 				return procErr
 			}
 
-			if err := p.Signal(syscall.SIGKILL); err != nil {
-				return err
+			if err := c.powerdown(p); err != nil {
+				log.Println("graceful shutdown of " + c.Alias + " failed, killing: " + err.Error())
+				if err := p.Signal(syscall.SIGKILL); err != nil && !errors.Is(err, os.ErrProcessDone) {
+					return err
+				}
 			}
 
-			pidFile := filepath.Join(c.Location, "alpine.pid")
-			sockFile := filepath.Join(c.Location, "alpine.sock")
-			qmpFile := filepath.Join(c.Location, "alpine.qmp")
-			os.Remove(pidFile)
-			os.Remove(sockFile)
-			os.Remove(qmpFile)
+			c.cleanRuntimeFiles()
+
+			log.Println(c.Alias + " stopped")
+			return nil
+		} else if status == StateUnknown {
+			// the pid file is unreadable, but qemu still answers on QMP
+			if err := c.quit(); err != nil {
+				return err
+			}
+			c.cleanRuntimeFiles()
 
 			log.Println(c.Alias + " stopped")
 			return nil
@@ -294,50 +499,122 @@ func (c *MachineConfig) Stop() error {
 	return nil
 }
 
-// Pauses an Alpine VM
-func (c *MachineConfig) Pause() error {
-	if status, pid := c.Status(); status == "Running" {
-		if pid > 0 {
-			p, procErr := os.FindProcess(pid)
-			if procErr != nil {
-				return procErr
-			}
-			if err := p.Signal(syscall.SIGSTOP); err != nil {
-				return err
-			}
-			log.Println(c.Alias + " paused")
+// quit asks qemu to exit over QMP and waits until it stops answering
+func (c *MachineConfig) quit() error {
+	mon, err := c.QMP()
+	if err != nil {
+		return err
+	}
+	// qemu closes the socket as it exits, so the response is not always delivered
+	mon.ExecuteTimeout("quit", nil, qmpTimeout)
+	mon.Close()
+
+	deadline := time.Now().Add(qmpTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := c.QueryStatus(); err != nil {
 			return nil
-		} else {
-			pidFile := filepath.Join(c.Location, "alpine.pid")
-			return errors.New("error pausing, incorrect PID in " + pidFile + "?")
 		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return errors.New("qemu of " + c.Alias + " did not exit after quit")
+}
+
+// powerdown sends an ACPI shutdown request to the guest and escalates to a
+// QMP quit if the guest has not exited within the grace period
+func (c *MachineConfig) powerdown(p *os.Process) error {
+	mon, err := c.QMP()
+	if err != nil {
+		return err
+	}
+	defer mon.Close()
+
+	grace := time.Duration(c.StopTimeout) * time.Second
+	if c.StopTimeout <= 0 {
+		grace = DefaultStopTimeout
+	}
+
+	if _, err := mon.ExecuteTimeout("system_powerdown", nil, qmpTimeout); err != nil {
+		return err
+	}
+	if waitForExit(p, grace) {
+		return nil
 	}
+
+	log.Println(c.Alias + " did not power down within " + grace.String() + ", asking qemu to quit")
+	// qemu closes the socket as it exits, so the response is not always delivered
+	mon.ExecuteTimeout("quit", nil, qmpTimeout)
+	if waitForExit(p, qmpTimeout) {
+		return nil
+	}
+	return errors.New("qemu did not exit after quit")
+}
+
+// waitForExit polls until process p is gone or timeout expires
+func waitForExit(p *os.Process, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := p.Signal(syscall.Signal(0)); err != nil {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// QMP connects to the instance's QMP socket. The caller must close the client.
+func (c *MachineConfig) QMP() (*qmp.Client, error) {
+	return qmp.Dial(filepath.Join(c.Location, "alpine.qmp"), qmpTimeout)
+}
+
+// Pauses an Alpine VM
+func (c *MachineConfig) Pause() error {
+	status, _, err := c.CheckTransition("pause", StatePaused)
+	if status == StatePaused {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	mon, err := c.QMP()
+	if err != nil {
+		return errors.New("error pausing " + c.Alias + ": " + err.Error())
+	}
+	defer mon.Close()
+
+	if _, err := mon.ExecuteTimeout("stop", nil, qmpTimeout); err != nil {
+		return err
+	}
+	log.Println(c.Alias + " paused")
 	return nil
 }
 
 // Unpauses an Alpine VM
 func (c *MachineConfig) Resume() error {
-	if status, pid := c.Status(); status == "Paused" {
-		if pid > 0 {
-			p, procErr := os.FindProcess(pid)
-			if procErr != nil {
-				return procErr
-			}
-			if err := p.Signal(syscall.SIGCONT); err != nil {
-				return err
-			}
-			_, err := c.Exec("hwclock -s", true)
-			if err != nil {
-				log.Println("failed to synchonrize clock, instance system clock may be skewed")
-				return err
-			}
-			log.Println(c.Alias + " resumed")
-			return nil
-		} else {
-			pidFile := filepath.Join(c.Location, "alpine.pid")
-			return errors.New("error resuming, incorrect PID in " + pidFile + "?")
-		}
+	status, _, err := c.CheckTransition("resume", StateRunning)
+	if status == StateRunning {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	mon, err := c.QMP()
+	if err != nil {
+		return errors.New("error resuming " + c.Alias + ": " + err.Error())
+	}
+	defer mon.Close()
+
+	command := "cont"
+	if status == StateSuspended {
+		command = "system_wakeup"
+	}
+	if _, err := mon.ExecuteTimeout(command, nil, qmpTimeout); err != nil {
+		return err
 	}
+	log.Println(c.Alias + " resumed")
 	return nil
 }
 
@@ -385,6 +662,9 @@ func (c *MachineConfig) GetAccel() string {
 
 // Start starts up an Alpine VM
 func (c *MachineConfig) Start() error {
+	if _, _, err := c.CheckTransition("start", StateStarting); err != nil {
+		return err
+	}
 
 	networkDevice := "user,id=net0,hostfwd=tcp::" + c.SSHPort + "-:22"
 
@@ -397,23 +677,26 @@ func (c *MachineConfig) Start() error {
 		c.MACAddress = macAddress
 	}
 
-	if c.VMNet {
+	switch {
+	case c.VMNet:
 		networkDevice = "vmnet-shared,id=net0"
+	case c.Bridge != "":
+		networkDevice = "bridge,id=net0,br=" + c.Bridge
+	case c.Tap != "":
+		networkDevice = "tap,id=net0,ifname=" + c.Tap + ",script=no,downscript=no"
 	}
 
 	// Only parse ports of using qemu's default slirp network
-	if !c.VMNet {
+	if !c.HostNetwork() {
+		networkDevice += c.slirpArgs()
+
 		ports, err := utils.ParsePort(c.Port)
 		if err != nil {
 			log.Fatalf("Error configuring ports: %v\n", err)
 		}
 		for _, p := range ports {
-			hostp := strconv.Itoa(p.Host)
-			guestp := strconv.Itoa(p.Guest)
-			if p.Proto == utils.Tcp {
-				networkDevice += ",hostfwd=tcp::" + hostp + "-:" + guestp
-			} else { // Udp
-				networkDevice += ",hostfwd=udp::" + hostp + "-:" + guestp
+			for _, q := range p.Expand() {
+				networkDevice += ",hostfwd=" + hostfwd(q)
 			}
 		}
 	}
@@ -485,14 +768,18 @@ func (c *MachineConfig) Start() error {
 		"-netdev", networkDevice,
 		"-pidfile", filepath.Join(c.Location, "alpine.pid"),
 		"-chardev", "socket,id=char-serial,path=" + filepath.Join(c.Location,
-			"alpine.sock") + ",server=on,wait=off,logfile=" + filepath.Join(c.Location, "alpine.log"),
+			"alpine.sock") + ",server=on,wait=off,logfile=" + c.SerialLog() + ",logappend=on",
 		"-serial", "chardev:char-serial",
 		"-chardev", "socket,id=char-qmp,path=" + filepath.Join(c.Location, "alpine.qmp") + ",server=on,wait=off",
 		"-qmp", "chardev:char-qmp",
+		"-chardev", "socket,id=char-qga,path=" + filepath.Join(c.Location, "alpine.qga") + ",server=on,wait=off",
+		"-device", "virtio-serial-pci",
+		"-device", "virtserialport,chardev=char-qga,name=org.qemu.guest_agent.0",
 		"-parallel", "none",
 		"-device", "virtio-rng-pci",
 		"-rtc", "base=utc,clock=host",
 		"-daemonize",
+		"-D", c.DebugLog(),
 		"-name", c.Alias}
 
 	if c.Arch == "aarch64" {
@@ -506,14 +793,36 @@ func (c *MachineConfig) Start() error {
 		qemuArgs = append(qemuArgs, mountArgs...)
 	}
 
-	cmd := exec.Command(qemuCmd, qemuArgs...)
+	nicArgs, err := c.nicArgs()
+	if err != nil {
+		return err
+	}
+	qemuArgs = append(qemuArgs, nicArgs...)
 
-	cmd.Stdout = os.Stdout
+	restoring := c.HasSavedState()
+	if restoring {
+		qemuArgs = append(qemuArgs, "-incoming", "file:"+c.StateFile())
+	}
 
-	// Uncomment to debug qemu messages
-	cmd.Stderr = os.Stderr
+	qemuLog, err := c.openLogs()
+	if err != nil {
+		return err
+	}
+	defer qemuLog.Close()
 
-	log.Println("booting " + c.Alias)
+	cmd := exec.Command(qemuCmd, qemuArgs...)
+
+	// this captures start up messages and errors; once qemu has daemonized,
+	// its diagnostics go to the debug log given with -D
+	logWriter := &utils.TimestampWriter{W: qemuLog}
+	cmd.Stdout = io.MultiWriter(os.Stdout, logWriter)
+	cmd.Stderr = io.MultiWriter(os.Stderr, logWriter)
+
+	if restoring {
+		log.Println("restoring " + c.Alias + " from saved state")
+	} else {
+		log.Println("booting " + c.Alias)
+	}
 	err = cmd.Run()
 	if err != nil {
 		c.Stop()
@@ -521,7 +830,32 @@ func (c *MachineConfig) Start() error {
 		return err
 	}
 
-	if c.Mount != "" {
+	expected := StateRunning
+	if restoring {
+		expected = c.restoredState()
+		err := c.waitForIncoming()
+		if status, _ := c.Status(); err == nil && status != expected {
+			err = errors.New("instance is " + string(status))
+		}
+		if err != nil {
+			c.Stop()
+			c.CleanPIDFile()
+			return errors.New("unable to restore saved state, run `alpine stop " + c.Alias + "` to discard it: " + err.Error())
+		}
+		// the state is only dropped once the instance is back
+		if err := c.DiscardSavedState(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(c.rekeyMarker()); err == nil && !restoring {
+		if err := c.rekey(); err != nil {
+			log.Println("error replacing the keys of " + c.Alias + ": " + err.Error())
+		}
+	}
+
+	// a restored guest still has its filesystems mounted
+	if c.Mount != "" && !restoring {
 		basename := filepath.Base(c.Mount)
 		mntcmd := make([]string, 3)
 		mntcmd[0] = "mkdir -p /mnt/" + basename
@@ -534,8 +868,27 @@ func (c *MachineConfig) Start() error {
 		}
 	}
 
+	// settings made on the host are applied again, defaults only at launch
+	if c.hasDNSSettings() && !restoring {
+		if err := c.configureDNS(); err != nil {
+			log.Println("error configuring DNS: " + err.Error())
+		}
+	}
+
+	if (c.hasProxySettings() || c.proxyApplied()) && !restoring {
+		if err := c.configureProxy(); err != nil {
+			log.Println("error configuring proxy: " + err.Error())
+		}
+	}
+
+	if len(c.NICs) > 0 && !restoring {
+		if err := c.configureNICs(); err != nil {
+			log.Println("error configuring network interfaces: " + err.Error())
+		}
+	}
+
 	status, pid := c.Status()
-	if status != "Running" {
+	if status != expected {
 		return errors.New("unable to start instance")
 	}
 
@@ -546,14 +899,7 @@ func (c *MachineConfig) Start() error {
 	// 	return err
 	// }
 
-	config, err := yaml.Marshal(&c)
-	if err != nil {
-		c.Stop()
-		c.CleanPIDFile()
-		return err
-	}
-
-	err = os.WriteFile(filepath.Join(c.Location, "config.yaml"), config, 0644)
+	err = SaveMachineConfig(*c)
 	if err != nil {
 		c.Stop()
 		c.CleanPIDFile()
@@ -579,29 +925,22 @@ func (c *MachineConfig) Start() error {
 // 	return ip
 // }
 
-// AssignIP obtains machine IP address from bootpd.plist. Only applicale to machines created on
-// VMNet
-func (c *MachineConfig) GetIPAddressByMac(dhcpLeasesContent []byte) (string, error) {
-	result := utils.ParseDhcpLeasesFile(string(dhcpLeasesContent))
-	dhcpData := utils.ConvertStringArrayToDhcpDataArray(result)
-	dhcpConfig := utils.MatchHwAddress(dhcpData, c.MACAddress)
-
-	if dhcpConfig != nil {
-		return dhcpConfig.IpAddress, nil
-	} else {
-		return "", errors.New("no machine dhcp configuration found")
-	}
-}
-
-// Launch macpine downloads a fresh image and creates a VM directory
-func (c *MachineConfig) Launch() error {
+// Launch macpine downloads a fresh image and creates a VM directory. With thin
+// set, the instance disk is a copy-on-write overlay of the cached image
+// rather than a copy of it. With sshKey set, the instance gets a keypair of
+// its own in place of the default password, and noPassword then turns off
+// password authentication in sshd.
+func (c *MachineConfig) Launch(thin bool, sshKey bool, noPassword bool) error {
 
 	userHomeDir, err := os.UserHomeDir()
 	if err != nil {
 		return err
 	}
 
-	cacheDir := filepath.Join(userHomeDir, ".macpine", "cache")
+	cacheDir, err := CacheDir()
+	if err != nil {
+		return err
+	}
 	err = os.MkdirAll(cacheDir, os.ModePerm)
 	if err != nil {
 		return err
@@ -616,6 +955,14 @@ func (c *MachineConfig) Launch() error {
 		}
 	}
 
+	// only overlays depend on the cached image staying as it is
+	if thin {
+		err = SealCacheImage(filepath.Join(cacheDir, c.Image))
+		if err != nil {
+			return err
+		}
+	}
+
 	if c.Arch == "aarch64" {
 		if _, err := os.Stat(filepath.Join(cacheDir, "qemu_efi.fd")); errors.Is(err, os.ErrNotExist) {
 			err = utils.DownloadFile(filepath.Join(cacheDir, "qemu_efi.fd"),
@@ -632,7 +979,12 @@ func (c *MachineConfig) Launch() error {
 		return err
 	}
 
-	_, err = utils.CopyFile(filepath.Join(cacheDir, c.Image), filepath.Join(targetDir, c.Image))
+	if thin {
+		err = createOverlay(filepath.Join(cacheDir, c.Image), filepath.Join(targetDir, c.Image))
+		c.Backing = filepath.Join(cacheDir, c.Image)
+	} else {
+		_, err = utils.CopyFile(filepath.Join(cacheDir, c.Image), filepath.Join(targetDir, c.Image))
+	}
 	if err != nil {
 		os.RemoveAll(targetDir)
 		return err
@@ -652,14 +1004,7 @@ func (c *MachineConfig) Launch() error {
 		return errors.New("unable to resize disk: " + err.Error())
 	}
 
-	config, err := yaml.Marshal(&c)
-
-	if err != nil {
-		os.RemoveAll(targetDir)
-		return err
-	}
-
-	err = os.WriteFile(filepath.Join(c.Location, "config.yaml"), config, 0644)
+	err = SaveMachineConfig(*c)
 	if err != nil {
 		os.RemoveAll(targetDir)
 		return err
@@ -673,33 +1018,19 @@ func (c *MachineConfig) Launch() error {
 	log.Println("waiting for machine...")
 	time.Sleep(10 * time.Second)
 
-	// Make sure DNS is set up correctly
-	_, err = c.Exec("echo 'nameserver 8.8.8.8' > /etc/resolv.conf", true)
-	if err != nil {
-		return errors.New("unable to set up DNS: " + err.Error())
+	// Make sure DNS is set up correctly. Start has already applied DNS
+	// settings made on the host.
+	if !c.hasDNSSettings() {
+		if err := c.configureDNS(); err != nil {
+			return errors.New("unable to set up DNS: " + err.Error())
+		}
 	}
 
-	_, err = c.Exec("apk update && apk add --no-cache dhclient", true)
+	_, err = c.Exec(proxyEnv+"apk update && apk add --no-cache dhclient", true)
 	if err != nil {
 		return errors.New("unable to install dhclient: " + err.Error())
 	}
 
-	_, err = c.Exec(`cat >/etc/dhcp/dhclient.conf <<EOL
-	option rfc3442-classless-static-routes code 121 = array of unsigned integer 8;
-
-	send host-name = gethostname();
-	request subnet-mask, broadcast-address, time-offset, routers,
-	        domain-name, domain-name-servers, domain-search, host-name,
-	        dhcp6.name-servers, dhcp6.domain-search, dhcp6.fqdn, dhcp6.sntp-servers,
-	        netbios-name-servers, netbios-scope, interface-mtu,
-	        rfc3442-classless-static-routes, ntp-servers;
-
-	prepend domain-name-servers 8.8.8.8, 8.8.4.4;
-	EOL`, true)
-	if err != nil {
-		return errors.New("unable to configure dhclient: " + err.Error())
-	}
-
 	_, err = c.Exec("rc-service networking restart", true)
 	if err != nil {
 		return errors.New("unable to restart networking services: " + err.Error())
@@ -708,7 +1039,7 @@ func (c *MachineConfig) Launch() error {
 	// Resize disk on an alpine guest
 	if strings.Split(c.Image, "_")[0] == "alpine" {
 		//TODO add these dependencies into pre-baked macpine image
-		_, err := c.Exec("apk add --no-cache e2fsprogs-extra sfdisk partx", true) // root=true i.e. run as root
+		_, err := c.Exec(proxyEnv+"apk add --no-cache e2fsprogs-extra sfdisk partx", true) // root=true i.e. run as root
 		if err != nil {
 			return errors.New("unable to install dependencies: " + err.Error())
 		}
@@ -732,36 +1063,46 @@ func (c *MachineConfig) Launch() error {
 		}
 	}
 
+	if sshKey {
+		if err := c.installSSHKey(noPassword); err != nil {
+			return errors.New("unable to install ssh key: " + err.Error())
+		}
+	}
+
 	return nil
 }
 
-// CompressQemuDiskImage compresses the QEMU Disk image and overwrites it
-func (c *MachineConfig) CompressQemuDiskImage() error {
+// CompressQemuDiskImage writes a compressed copy of the QEMU disk image to
+// dir, next to a config.yaml that describes it. The copy has its backing
+// chain flattened and carries no snapshots, and the instance itself is left
+// untouched. It returns the paths of both files.
+func (c *MachineConfig) CompressQemuDiskImage(dir string) ([]string, error) {
 	if !utils.CommandExists("qemu-img") {
-		return errors.New("qemu-img is not available on $PATH. ensure qemu is installed")
+		return nil, errors.New("qemu-img is not available on $PATH. ensure qemu is installed")
 	}
 
-	cmd := exec.Command("qemu-img", "convert", "-c", "-O", "qcow2", filepath.Join(c.Location, c.Image),
-		filepath.Join(c.Location, c.Image+"_compressed.qcow2"))
-
-	err := cmd.Run()
-	if err != nil {
-		fmt.Println(err.Error())
-		return err
+	image := filepath.Join(dir, c.Image)
+	cmd := exec.Command("qemu-img", "convert", "-c", "-O", "qcow2", filepath.Join(c.Location, c.Image), image)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("qemu-img convert: %v: %s", err, out)
 	}
 
-	err = os.Remove(filepath.Join(c.Location, c.Image))
-	if err != nil {
-		return err
+	if len(c.Snapshots) > 0 {
+		log.Println("snapshots of " + c.Alias + " are not part of its compressed disk")
 	}
-
-	err = os.Rename(filepath.Join(c.Location, c.Image+"_compressed.qcow2"),
-		filepath.Join(c.Location, c.Image))
+	compressed := *c
+	compressed.Backing = ""
+	compressed.Snapshots = nil
+	content, err := yaml.Marshal(&compressed)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	config := filepath.Join(dir, "config.yaml")
+	if err := utils.WriteFileAtomic(config, content, 0600); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return []string{image, config}, nil
 }
 
 // DecompressQemuDiskImage decompresses the QEMU Disk image and overwrites it
@@ -843,19 +1184,18 @@ func (c *MachineConfig) CleanPIDFile() {
 func (c *MachineConfig) GetInstancePID() (int, error) {
 	pidFile := filepath.Join(c.Location, "alpine.pid")
 
-	_, err := os.Open(pidFile)
-	if err != nil {
-		return 0, errors.New("you don't have enough priveledges to view " + c.Alias + ". run sudo alpine list")
-	}
-
 	vmPID, err := os.ReadFile(pidFile)
+	if errors.Is(err, os.ErrPermission) {
+		return 0, fmt.Errorf("you don't have enough priveledges to view %s. run sudo alpine list: %w", c.Alias, err)
+	}
 	if err != nil {
 		return 0, err
 	}
 
-	process := string(vmPID)
-	process = strings.TrimSuffix(process, "\n")
-	pid, _ := strconv.Atoi(process)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(vmPID)))
+	if err != nil {
+		return 0, errors.New("invalid pid file " + pidFile + ": " + err.Error())
+	}
 
 	return pid, nil
 }
@@ -886,7 +1226,7 @@ func SaveMachineConfig(machineConfig MachineConfig) error {
 		return err
 	}
 
-	err = os.WriteFile(filepath.Join(machineConfig.Location, "config.yaml"), updatedConfig, 0644)
+	err = utils.WriteFileAtomic(filepath.Join(machineConfig.Location, "config.yaml"), updatedConfig, 0600)
 	if err != nil {
 		return err
 	}
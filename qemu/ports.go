@@ -0,0 +1,147 @@
+package qemu
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/beringresearch/macpine/utils"
+)
+
+// hostfwd returns the user network forwarding rule for a single port mapping
+func hostfwd(p utils.PortMap) string {
+	return hostfwdHost(p) + "-:" + strconv.Itoa(p.Guest)
+}
+
+// hostfwdHost returns the host side of the forwarding rule for a single port,
+// which is how hostfwd_remove identifies it. IPv6 addresses are bracketed.
+func hostfwdHost(p utils.PortMap) string {
+	address := p.Address
+	if strings.Contains(address, ":") {
+		address = "[" + address + "]"
+	}
+	return p.Proto.String() + ":" + address + ":" + strconv.Itoa(p.Host)
+}
+
+// findPort returns the index of the mapping that forwards the same host ports
+// as p, or -1. The address of p is only compared if it is set.
+func findPort(maps []utils.PortMap, p utils.PortMap) int {
+	for i, q := range maps {
+		if q.Host == p.Host && q.Count == p.Count && q.Proto == p.Proto && (p.Address == "" || q.Address == p.Address) {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddPorts forwards ports, given in the config.yaml port syntax, to the
+// instance. Forwards take effect immediately on a running instance and are
+// saved to its configuration for later starts.
+func (c *MachineConfig) AddPorts(ports string) error {
+	if c.HostNetwork() {
+		return errors.New("port forwarding is not available on host networks, connect to the instance address instead")
+	}
+
+	add, err := utils.ParsePort(ports)
+	if err != nil {
+		return err
+	}
+	current, err := utils.ParsePort(c.Port)
+	if err != nil {
+		return err
+	}
+
+	sshPort, _ := strconv.Atoi(c.SSHPort)
+	ssh := utils.PortMap{Host: sshPort, Count: 1, Proto: utils.Tcp}
+	forwarded := append([]utils.PortMap{}, current...)
+	for _, p := range add {
+		if p.Overlaps(ssh) {
+			return errors.New("host port " + c.SSHPort + " is the ssh port of " + c.Alias)
+		}
+		for _, q := range forwarded {
+			if p.Overlaps(q) {
+				return errors.New("host port(s) " + p.String() + " overlap the forward " + q.String())
+			}
+		}
+		forwarded = append(forwarded, p)
+	}
+
+	if status, _ := c.Status(); status.Active() {
+		var added []utils.PortMap
+		for _, p := range add {
+			for _, q := range p.Expand() {
+				if err := c.monitor("hostfwd_add net0 " + hostfwd(q)); err != nil {
+					// leave the instance as it was
+					for _, r := range added {
+						c.monitor("hostfwd_remove net0 " + hostfwdHost(r))
+					}
+					return err
+				}
+				added = append(added, q)
+			}
+		}
+	}
+
+	c.Port = utils.FormatPorts(forwarded)
+	return SaveMachineConfig(*c)
+}
+
+// RemovePorts stops forwarding the given host ports to the instance, both
+// immediately and in its saved configuration
+func (c *MachineConfig) RemovePorts(ports string) error {
+	remove, err := utils.ParsePort(ports)
+	if err != nil {
+		return err
+	}
+	current, err := utils.ParsePort(c.Port)
+	if err != nil {
+		return err
+	}
+
+	var removed []utils.PortMap
+	for _, p := range remove {
+		i := findPort(current, p)
+		if i < 0 {
+			return errors.New("host port(s) " + p.String() + " are not forwarded to " + c.Alias)
+		}
+		removed = append(removed, current[i])
+		current = append(current[:i], current[i+1:]...)
+	}
+
+	if status, _ := c.Status(); status.Active() {
+		var dropped []utils.PortMap
+		for _, p := range removed {
+			for _, q := range p.Expand() {
+				if err := c.monitor("hostfwd_remove net0 " + hostfwdHost(q)); err != nil {
+					// leave the instance as it was
+					for _, r := range dropped {
+						c.monitor("hostfwd_add net0 " + hostfwd(r))
+					}
+					return err
+				}
+				dropped = append(dropped, q)
+			}
+		}
+	}
+
+	c.Port = utils.FormatPorts(current)
+	return SaveMachineConfig(*c)
+}
+
+// monitor runs a human monitor command that prints nothing on success
+func (c *MachineConfig) monitor(command string) error {
+	mon, err := c.QMP()
+	if err != nil {
+		return err
+	}
+	defer mon.Close()
+
+	out, err := mon.HumanMonitorCommand(command)
+	if err != nil {
+		return err
+	}
+	if out = strings.TrimSpace(out); out != "" {
+		return errors.New(command + ": " + out)
+	}
+	return nil
+}
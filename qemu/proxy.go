@@ -0,0 +1,184 @@
+package qemu
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// proxyProfile is the guest script that exports the proxy settings to
+// login shells
+const proxyProfile = "/etc/profile.d/proxy.sh"
+
+// proxyEnv prefixes guest commands that download, as commands run over ssh do
+// not read the login profile
+const proxyEnv = "[ -f " + proxyProfile + " ] && . " + proxyProfile + "; "
+
+// caCertificate is where the CA bundle of the instance is installed in the
+// guest, for update-ca-certificates to pick up
+const caCertificate = "/usr/local/share/ca-certificates/macpine.crt"
+
+// guestCABundle is the system CA bundle of the guest
+const guestCABundle = "/etc/ssl/certs/ca-certificates.crt"
+
+const (
+	caBegin = "# BEGIN macpine"
+	caEnd   = "# END macpine"
+)
+
+// HostProxy returns the proxy settings of the host environment, preferring
+// the lower case variables as curl and wget do
+func HostProxy() (httpProxy string, httpsProxy string, noProxy string) {
+	env := func(name string) string {
+		if v := os.Getenv(strings.ToLower(name)); v != "" {
+			return v
+		}
+		return os.Getenv(name)
+	}
+	return env("HTTP_PROXY"), env("HTTPS_PROXY"), env("NO_PROXY")
+}
+
+// CheckProxySettings validates the proxy settings and the CA bundle
+func (c *MachineConfig) CheckProxySettings() error {
+	for _, proxy := range []string{c.HTTPProxy, c.HTTPSProxy} {
+		if proxy == "" {
+			continue
+		}
+		u, err := parseProxy(proxy)
+		if err != nil || u.Host == "" {
+			return errors.New("invalid proxy " + proxy + ", use a URL such as http://proxy.example.com:3128")
+		}
+	}
+
+	if c.CABundle != "" {
+		pem, err := os.ReadFile(c.CABundle)
+		if err != nil {
+			return errors.New("unable to read CA bundle: " + err.Error())
+		}
+		if !strings.Contains(string(pem), "-----BEGIN CERTIFICATE-----") {
+			return errors.New("CA bundle " + c.CABundle + " holds no PEM certificates")
+		}
+	}
+	return nil
+}
+
+// hasProxySettings reports whether the instance has proxy settings or a CA
+// bundle to apply to the guest
+func (c *MachineConfig) hasProxySettings() bool {
+	return c.HTTPProxy != "" || c.HTTPSProxy != "" || c.NoProxy != "" || c.CABundle != ""
+}
+
+// proxyMarker records that proxy settings were applied to the guest, so that
+// they are also removed from it once the instance drops them
+func (c *MachineConfig) proxyMarker() string {
+	return filepath.Join(c.Location, "alpine.proxy")
+}
+
+// proxyApplied reports whether proxy settings were applied to the guest
+func (c *MachineConfig) proxyApplied() bool {
+	_, err := os.Stat(c.proxyMarker())
+	return err == nil
+}
+
+// guestProxy rewrites a proxy on the host loopback, such as a local
+// authenticating proxy, to the address at which the guest reaches the host
+func (c *MachineConfig) guestProxy(proxy string) string {
+	u, err := parseProxy(proxy)
+	if err != nil || c.HostNetwork() {
+		return proxy
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return proxy
+	}
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(c.SlirpHost(), port)
+	} else {
+		u.Host = c.SlirpHost()
+	}
+	return u.String()
+}
+
+// parseProxy parses a proxy URL. Like curl, it takes proxies without a
+// scheme, such as proxy.example.com:3128, to be http proxies.
+func parseProxy(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	return url.Parse(proxy)
+}
+
+// configureProxy writes the proxy settings of the instance to the guest
+// profile, and adds its CA bundle to the certificates the guest trusts.
+// Settings the instance no longer has are removed from the guest.
+func (c *MachineConfig) configureProxy() error {
+	if !c.hasProxySettings() {
+		if !c.proxyApplied() {
+			return nil
+		}
+		_, err := c.Exec("rm -f "+proxyProfile+" "+caCertificate+" && "+
+			"sed -i '/^"+caBegin+"$/,/^"+caEnd+"$/d' "+guestCABundle, true)
+		if err != nil {
+			return err
+		}
+		return os.Remove(c.proxyMarker())
+	}
+
+	var profile []string
+	for _, v := range []struct{ name, value string }{
+		{"http_proxy", c.guestProxy(c.HTTPProxy)},
+		{"https_proxy", c.guestProxy(c.HTTPSProxy)},
+		{"no_proxy", c.NoProxy},
+	} {
+		if v.value == "" {
+			continue
+		}
+		quoted := "'" + strings.ReplaceAll(v.value, "'", `'\''`) + "'"
+		profile = append(profile,
+			"export "+v.name+"="+quoted,
+			"export "+strings.ToUpper(v.name)+"="+quoted)
+	}
+
+	// proxies may carry credentials, so only root and the ssh user can
+	// read the profile
+	_, err := c.Exec(`rm -f `+proxyProfile+` && touch `+proxyProfile+` && chmod 600 `+proxyProfile+` && `+
+		`chown '`+c.SSHUser+`' `+proxyProfile+` && cat >`+proxyProfile+` <<'EOL'
+`+strings.Join(profile, "\n")+`
+EOL`, true)
+	if err != nil {
+		return err
+	}
+
+	if c.CABundle == "" {
+		_, err = c.Exec("rm -f "+caCertificate+" && "+
+			"sed -i '/^"+caBegin+"$/,/^"+caEnd+"$/d' "+guestCABundle, true)
+		if err != nil {
+			return err
+		}
+	} else {
+		pem, err := os.ReadFile(c.CABundle)
+		if err != nil {
+			return err
+		}
+		bundle := strings.TrimSpace(string(pem))
+
+		_, err = c.Exec(`mkdir -p `+filepath.Dir(caCertificate)+` && cat >`+caCertificate+` <<'EOL'
+`+bundle+`
+EOL`, true)
+		if err != nil {
+			return err
+		}
+		// the bundle is spliced into the system bundle directly, as
+		// update-ca-certificates is not part of the base image
+		_, err = c.Exec("sed -i '/^"+caBegin+"$/,/^"+caEnd+"$/d' "+guestCABundle+" && "+
+			"{ echo '"+caBegin+"'; cat "+caCertificate+"; echo '"+caEnd+"'; } >> "+guestCABundle, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.WriteFile(c.proxyMarker(), nil, 0644)
+}
@@ -0,0 +1,243 @@
+package qemu
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/beringresearch/macpine/qmp"
+	"github.com/beringresearch/macpine/utils"
+)
+
+// Snapshot records an internal qcow2 snapshot of an instance disk
+type Snapshot struct {
+	Name        string    `yaml:"name"`
+	Created     time.Time `yaml:"created"`
+	Description string    `yaml:"description,omitempty"`
+	VMState     bool      `yaml:"vmstate"` // true if RAM and device state were saved alongside the disk
+}
+
+// GetSnapshot returns the named snapshot, or nil if it does not exist
+func (c *MachineConfig) GetSnapshot(name string) *Snapshot {
+	for i := range c.Snapshots {
+		if c.Snapshots[i].Name == name {
+			return &c.Snapshots[i]
+		}
+	}
+	return nil
+}
+
+// CreateSnapshot checkpoints the instance disk. Running instances also have
+// their memory saved, so that restoring resumes exactly where they left off.
+func (c *MachineConfig) CreateSnapshot(name string, description string) error {
+	if c.GetSnapshot(name) != nil {
+		return errors.New("snapshot " + name + " already exists")
+	}
+
+	snapshot := Snapshot{Name: name, Created: time.Now(), Description: description}
+
+	if status, _ := c.Status(); !status.Active() {
+		if err := c.qemuImgSnapshot("-c", name); err != nil {
+			return err
+		}
+	} else {
+		if err := c.checkVMStateSavable("snapshot running instance"); err != nil {
+			return errors.New(err.Error() + ". stop the instance to snapshot its disk")
+		}
+		err := c.snapshotJob("snapshot-save", name, true)
+		if err != nil {
+			return err
+		}
+		snapshot.VMState = true
+	}
+
+	c.Snapshots = append(c.Snapshots, snapshot)
+	if err := SaveMachineConfig(*c); err != nil {
+		return err
+	}
+
+	log.Println("created snapshot " + name + " of " + c.Alias)
+	return nil
+}
+
+// RestoreSnapshot reverts the instance to a snapshot
+func (c *MachineConfig) RestoreSnapshot(name string) error {
+	snapshot := c.GetSnapshot(name)
+	if snapshot == nil {
+		return errors.New("unknown snapshot " + name)
+	}
+
+	// restoring the disk under a saved RAM state would corrupt the guest
+	status, _, err := c.RequireState("restore", StateStopped, StateCrashed, StateRunning, StatePaused)
+	if err != nil {
+		return err
+	}
+
+	if !status.Active() {
+		if err := c.qemuImgSnapshot("-a", name); err != nil {
+			return err
+		}
+	} else {
+		if !snapshot.VMState {
+			return errors.New("snapshot " + name + " was taken while " + c.Alias + " was stopped. stop the instance to restore it")
+		}
+		if err := c.snapshotJob("snapshot-load", name, true); err != nil {
+			return err
+		}
+	}
+
+	log.Println("restored " + c.Alias + " to snapshot " + name)
+	return nil
+}
+
+// DeleteSnapshot removes a snapshot from the instance disk
+func (c *MachineConfig) DeleteSnapshot(name string) error {
+	if c.GetSnapshot(name) == nil {
+		return errors.New("unknown snapshot " + name)
+	}
+
+	var err error
+	if status, _ := c.Status(); !status.Active() {
+		err = c.qemuImgSnapshot("-d", name)
+	} else {
+		err = c.snapshotJob("snapshot-delete", name, false)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := range c.Snapshots {
+		if c.Snapshots[i].Name == name {
+			c.Snapshots = append(c.Snapshots[:i], c.Snapshots[i+1:]...)
+			break
+		}
+	}
+	if err := SaveMachineConfig(*c); err != nil {
+		return err
+	}
+
+	log.Println("deleted snapshot " + name + " of " + c.Alias)
+	return nil
+}
+
+func (c *MachineConfig) qemuImgSnapshot(op string, name string) error {
+	if !utils.CommandExists("qemu-img") {
+		return errors.New("qemu-img is not available on $PATH. ensure qemu is installed")
+	}
+
+	out, err := exec.Command("qemu-img", "snapshot", op, name, filepath.Join(c.Location, c.Image)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img snapshot %s: %v: %s", op, err, out)
+	}
+	return nil
+}
+
+// snapshotJob runs one of the snapshot-save, snapshot-load or snapshot-delete
+// QMP jobs against the instance disk and waits for it to finish
+func (c *MachineConfig) snapshotJob(command string, name string, vmstate bool) error {
+	mon, err := c.QMP()
+	if err != nil {
+		return err
+	}
+	defer mon.Close()
+
+	node, err := c.diskNodeName(mon)
+	if err != nil {
+		return err
+	}
+
+	jobID := command + "-" + name
+	args := map[string]interface{}{
+		"job-id":  jobID,
+		"tag":     name,
+		"devices": []string{node},
+	}
+	if vmstate {
+		args["vmstate"] = node
+	}
+
+	if _, err := mon.ExecuteTimeout(command, args, qmpTimeout); err != nil {
+		return err
+	}
+	return waitForJob(mon, jobID)
+}
+
+// diskNodeName finds the block node backing the instance disk
+func (c *MachineConfig) diskNodeName(mon *qmp.Client) (string, error) {
+	ret, err := mon.ExecuteTimeout("query-block", nil, qmpTimeout)
+	if err != nil {
+		return "", err
+	}
+
+	var blocks []struct {
+		Inserted *struct {
+			NodeName string `json:"node-name"`
+			File     string `json:"file"`
+		} `json:"inserted"`
+	}
+	if err := json.Unmarshal(ret, &blocks); err != nil {
+		return "", err
+	}
+
+	image := filepath.Join(c.Location, c.Image)
+	for _, b := range blocks {
+		if b.Inserted != nil && b.Inserted.File == image {
+			return b.Inserted.NodeName, nil
+		}
+	}
+	return "", errors.New("unable to find disk " + image + " in running instance")
+}
+
+// snapshotJobTimeout bounds how long a snapshot job may run, which includes
+// writing out the memory of a running instance
+const snapshotJobTimeout = 10 * time.Minute
+
+// waitForJob polls a QMP background job until it concludes, then dismisses it.
+// It gives up on a job that disappears or runs past snapshotJobTimeout.
+func waitForJob(mon *qmp.Client, jobID string) error {
+	deadline := time.Now().Add(snapshotJobTimeout)
+	for {
+		ret, err := mon.ExecuteTimeout("query-jobs", nil, qmpTimeout)
+		if err != nil {
+			return err
+		}
+
+		var jobs []struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+		if err := json.Unmarshal(ret, &jobs); err != nil {
+			return err
+		}
+
+		found := false
+		for _, j := range jobs {
+			if j.ID != jobID {
+				continue
+			}
+			found = true
+			if j.Status != "concluded" {
+				break
+			}
+			mon.ExecuteTimeout("job-dismiss", map[string]string{"id": jobID}, qmpTimeout)
+			if j.Error != "" {
+				return errors.New(j.Error)
+			}
+			return nil
+		}
+		if !found {
+			return errors.New("job " + jobID + " disappeared before it concluded")
+		}
+
+		if time.Now().After(deadline) {
+			mon.ExecuteTimeout("job-cancel", map[string]string{"id": jobID}, qmpTimeout)
+			return errors.New("timed out waiting for job " + jobID)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
@@ -0,0 +1,178 @@
+package qemu
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/beringresearch/macpine/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHKeyFile is the private key generated for each instance at launch, kept
+// in the instance directory next to SSHKeyFile + ".pub"
+const SSHKeyFile = "id_ed25519"
+
+// sourceKeyFile holds the keypair a clone is given by the instance it was
+// cloned from, until it has generated its own
+const sourceKeyFile = "id_ed25519.source"
+
+// RootPasswordFile holds the root password generated for each instance at
+// launch, in the instance directory
+const RootPasswordFile = "root.password"
+
+// KeyPath resolves the file of a key:: credential, which is relative to the
+// instance directory unless absolute
+func (c *MachineConfig) KeyPath(path string) string {
+	if expanded, err := utils.ExpandHome(path); err == nil {
+		path = expanded
+	}
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(c.Location, path)
+}
+
+// keySigner reads the private key of a key:: credential
+func (c *MachineConfig) keySigner(path string) (ssh.Signer, error) {
+	path = c.KeyPath(path)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("unable to read ssh key: " + err.Error())
+	}
+	signer, err := ssh.ParsePrivateKey(content)
+	if err != nil {
+		return nil, errors.New("unable to parse ssh key " + path + ": " + err.Error())
+	}
+	return signer, nil
+}
+
+// generateSSHKey writes a new ed25519 keypair of the instance and returns its
+// public key in authorized_keys format
+func (c *MachineConfig) generateSSHKey() (string, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := ssh.MarshalPrivateKey(private, "macpine@"+c.Alias)
+	if err != nil {
+		return "", err
+	}
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+	authorized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublic))) + " macpine@" + c.Alias
+
+	keyFile := filepath.Join(c.Location, SSHKeyFile)
+	if err := utils.WriteFileAtomic(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		return "", err
+	}
+	if err := utils.WriteFileAtomic(keyFile+".pub", []byte(authorized+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return authorized, nil
+}
+
+// installSSHKey generates the keypair of the instance, authorizes it for the
+// ssh user and switches the instance over to it. Once the key is known to
+// work, the root password of the image is replaced by one kept in
+// RootPasswordFile, and with noPassword set, sshd stops accepting passwords at
+// all.
+func (c *MachineConfig) installSSHKey(noPassword bool) error {
+	authorized, err := c.generateSSHKey()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Exec("mkdir -p ~/.ssh && chmod 700 ~/.ssh && "+
+		"printf '%s\\n' '"+authorized+"' >> ~/.ssh/authorized_keys && chmod 600 ~/.ssh/authorized_keys", false)
+	if err != nil {
+		return err
+	}
+
+	password := c.SSHPassword
+	c.SSHPassword = "key::" + SSHKeyFile
+	if _, err := c.Exec("true", false); err != nil {
+		c.SSHPassword = password
+		return errors.New("instance does not accept its key: " + err.Error())
+	}
+	if err := SaveMachineConfig(*c); err != nil {
+		return err
+	}
+
+	// the well known password of the image is replaced by a random one
+	// rather than locked, as sshd without PAM also refuses keys for locked
+	// accounts. It is kept for the serial console.
+	if c.SSHUser == "root" {
+		if err := c.replaceRootPassword(); err != nil {
+			return errors.New("unable to replace the root password: " + err.Error())
+		}
+	}
+
+	if noPassword {
+		// sshd takes the first value it reads, ahead of any included file
+		_, err = c.Exec("sed -i -E -e '1i PasswordAuthentication no' -e '/^#?PasswordAuthentication[[:space:]]/d' /etc/ssh/sshd_config && "+
+			"rc-service sshd reload", true)
+		if err != nil {
+			return errors.New("unable to disable password authentication: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// replaceRootPassword sets a random root password in the guest, after saving
+// it to RootPasswordFile and the instance config as a file:: credential
+func (c *MachineConfig) replaceRootPassword() error {
+	secret := make([]byte, 18)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	password := base64.RawURLEncoding.EncodeToString(secret)
+
+	if err := utils.WriteFileAtomic(filepath.Join(c.Location, RootPasswordFile), []byte(password+"\n"), 0600); err != nil {
+		return err
+	}
+	forgetCredential("file::" + c.KeyPath(RootPasswordFile))
+	if _, err := c.Exec("echo 'root:"+password+"' | chpasswd", true); err != nil {
+		return err
+	}
+
+	rootPassword := "file::" + RootPasswordFile
+	c.RootPassword = &rootPassword
+	return SaveMachineConfig(*c)
+}
+
+// replaceSourceKey swaps the keypair a clone was given by its source for one of
+// its own, and revokes the key of the source in the guest
+func (c *MachineConfig) replaceSourceKey() error {
+	public, err := os.ReadFile(filepath.Join(c.Location, sourceKeyFile+".pub"))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(public))
+	if len(fields) < 2 {
+		return errors.New("invalid public key in " + sourceKeyFile + ".pub")
+	}
+
+	if err := c.installSSHKey(false); err != nil {
+		return err
+	}
+	// base64 has no |, which is safe as the address delimiter
+	if _, err := c.Exec("sed -i '\\|"+fields[1]+"|d' ~/.ssh/authorized_keys", false); err != nil {
+		return err
+	}
+
+	for _, f := range []string{sourceKeyFile, sourceKeyFile + ".pub"} {
+		if err := os.Remove(filepath.Join(c.Location, f)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
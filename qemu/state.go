@@ -0,0 +1,130 @@
+package qemu
+
+import (
+	"errors"
+	"strings"
+)
+
+// State is the lifecycle state of an instance
+type State string
+
+const (
+	StateStopped   State = "Stopped"
+	StateStarting  State = "Starting"
+	StateRunning   State = "Running"
+	StatePaused    State = "Paused"
+	StateSuspended State = "Suspended" // guest suspended itself to RAM
+	StatePanicked  State = "Panicked"  // guest kernel panicked, QEMU still running
+	StateStopping  State = "Stopping"
+	StateSaved     State = "Saved" // suspended to disk by alpine suspend
+	StateCrashed   State = "Crashed"
+	StateUnknown   State = "Unknown"
+)
+
+var (
+	// ErrAlreadyRunning is returned for operations that need a stopped instance
+	ErrAlreadyRunning = errors.New("already running")
+	// ErrNotRunning is returned for operations that need a running instance
+	ErrNotRunning = errors.New("not running")
+	// ErrInvalidState is returned for operations that are invalid in any other way
+	ErrInvalidState = errors.New("invalid state")
+)
+
+// transitions lists the states each state can move to
+var transitions = map[State][]State{
+	StateStopped:   {StateStarting},
+	StateSaved:     {StateStarting, StateStopped},
+	StateCrashed:   {StateStarting, StateStopped},
+	StateStarting:  {StateRunning, StateStopping, StateCrashed},
+	StateRunning:   {StatePaused, StateSuspended, StatePanicked, StateSaved, StateStopping, StateCrashed},
+	StatePaused:    {StateRunning, StateSaved, StateStopping, StateCrashed},
+	StateSuspended: {StateRunning, StateStopping, StateCrashed},
+	StatePanicked:  {StateStopping, StateCrashed},
+	StateStopping:  {StateStopped, StateCrashed},
+	StateUnknown:   {StateStopping, StateStopped, StateCrashed}, // qemu answers on QMP but its pid file is unreadable
+}
+
+// Active reports whether a QEMU process exists for the instance
+func (s State) Active() bool {
+	switch s {
+	case StateStarting, StateRunning, StatePaused, StateSuspended, StatePanicked, StateStopping:
+		return true
+	}
+	return false
+}
+
+// CanTransitionTo reports whether an instance in state s can move to state to
+func (s State) CanTransitionTo(to State) bool {
+	for _, next := range transitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StateError reports an operation that is not valid in an instance's state
+type StateError struct {
+	Alias string
+	Op    string
+	State State
+	Err   error
+}
+
+func (e *StateError) Error() string {
+	return "cannot " + e.Op + " " + e.Alias + ": instance is " + strings.ToLower(string(e.State))
+}
+
+func (e *StateError) Unwrap() error {
+	return e.Err
+}
+
+// CheckTransition returns the current state and pid of the instance, or a
+// StateError if op, which moves the instance to state to, is not valid now
+func (c *MachineConfig) CheckTransition(op string, to State) (State, int, error) {
+	status, pid := c.Status()
+	if status.CanTransitionTo(to) {
+		return status, pid, nil
+	}
+
+	var from []State
+	for s := range transitions {
+		if s.CanTransitionTo(to) {
+			from = append(from, s)
+		}
+	}
+	return status, pid, c.stateError(op, status, from)
+}
+
+// RequireState returns the current state and pid of the instance, or a
+// StateError if it is in none of the given states
+func (c *MachineConfig) RequireState(op string, states ...State) (State, int, error) {
+	status, pid := c.Status()
+	for _, s := range states {
+		if status == s {
+			return status, pid, nil
+		}
+	}
+	return status, pid, c.stateError(op, status, states)
+}
+
+// stateError picks the error for an instance in state status when op needs one
+// of the wanted states
+func (c *MachineConfig) stateError(op string, status State, wanted []State) error {
+	wantActive, wantInactive := false, false
+	for _, s := range wanted {
+		if s.Active() {
+			wantActive = true
+		} else {
+			wantInactive = true
+		}
+	}
+
+	err := ErrInvalidState
+	if status.Active() && wantInactive && !wantActive {
+		err = ErrAlreadyRunning
+	} else if !status.Active() && status != StateUnknown && wantActive && !wantInactive {
+		err = ErrNotRunning
+	}
+	return &StateError{Alias: c.Alias, Op: op, State: status, Err: err}
+}
@@ -0,0 +1,226 @@
+package qemu
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/beringresearch/macpine/qmp"
+)
+
+// StateFile is where a suspended instance's RAM and device state is kept
+func (c *MachineConfig) StateFile() string {
+	return filepath.Join(c.Location, "alpine.state")
+}
+
+// pausedMarker records that the instance was paused when it was suspended,
+// and is to be restored paused
+func (c *MachineConfig) pausedMarker() string {
+	return c.StateFile() + ".paused"
+}
+
+// incomingTimeout bounds how long a restored instance may take to load its
+// saved state
+const incomingTimeout = 5 * time.Minute
+
+// migrationTimeout bounds how long saving the state of an instance may take
+const migrationTimeout = 10 * time.Minute
+
+// checkVMStateSavable returns an error if the instance mounts a directory,
+// as the 9p device of the mount keeps QEMU from saving the VM state
+func (c *MachineConfig) checkVMStateSavable(what string) error {
+	if c.Mount != "" {
+		return errors.New("cannot " + what + " " + c.Alias + " while it mounts " + c.Mount + ", as QEMU cannot save the state of a 9p mount")
+	}
+	return nil
+}
+
+// checkMigratable returns an error if the state of the instance cannot be
+// saved to a file, which QEMU supports since 8.2
+func (c *MachineConfig) checkMigratable(mon *qmp.Client, what string) error {
+	if err := c.checkVMStateSavable(what); err != nil {
+		return err
+	}
+
+	ret, err := mon.ExecuteTimeout("query-version", nil, qmpTimeout)
+	if err != nil {
+		return err
+	}
+	var info struct {
+		QEMU struct {
+			Major int `json:"major"`
+			Minor int `json:"minor"`
+		} `json:"qemu"`
+	}
+	if err := json.Unmarshal(ret, &info); err != nil {
+		return err
+	}
+	if info.QEMU.Major < 8 || (info.QEMU.Major == 8 && info.QEMU.Minor < 2) {
+		return fmt.Errorf("cannot %s %s with QEMU %d.%d, saving state to a file requires QEMU 8.2 or newer", what, c.Alias, info.QEMU.Major, info.QEMU.Minor)
+	}
+	return nil
+}
+
+// HasSavedState reports whether the instance was suspended to disk
+func (c *MachineConfig) HasSavedState() bool {
+	_, err := os.Stat(c.StateFile())
+	return err == nil
+}
+
+// Suspend saves the full state of a running VM to disk and stops QEMU. The
+// next Start restores the VM from that state.
+func (c *MachineConfig) Suspend() error {
+	status, pid, err := c.CheckTransition("suspend", StateSaved)
+	if err != nil {
+		return err
+	}
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	mon, err := c.QMP()
+	if err != nil {
+		return err
+	}
+	defer mon.Close()
+
+	if err := c.checkMigratable(mon, "suspend"); err != nil {
+		return err
+	}
+
+	if status == StateRunning {
+		if _, err := mon.ExecuteTimeout("stop", nil, qmpTimeout); err != nil {
+			return err
+		}
+	}
+
+	partial := c.StateFile() + ".tmp"
+	_, err = mon.ExecuteTimeout("migrate", map[string]string{"uri": "file:" + partial}, qmpTimeout)
+	if err == nil {
+		err = waitForMigration(mon)
+	}
+	if err == nil && status != StateRunning {
+		err = os.WriteFile(c.pausedMarker(), nil, 0644)
+	}
+	if err == nil {
+		err = os.Rename(partial, c.StateFile())
+	}
+	if err != nil {
+		os.Remove(partial)
+		os.Remove(c.pausedMarker())
+		if status == StateRunning {
+			mon.ExecuteTimeout("cont", nil, qmpTimeout)
+		}
+		return errors.New("unable to save state of " + c.Alias + ": " + err.Error())
+	}
+
+	// qemu closes the socket as it exits, so the response is not always delivered
+	mon.ExecuteTimeout("quit", nil, qmpTimeout)
+	if !waitForExit(p, qmpTimeout) {
+		p.Kill()
+	}
+
+	c.cleanRuntimeFiles()
+
+	log.Println(c.Alias + " suspended to disk")
+	return nil
+}
+
+// DiscardSavedState removes the state saved by Suspend, so that the next
+// Start cold boots the instance
+func (c *MachineConfig) DiscardSavedState() error {
+	for _, f := range []string{c.StateFile(), c.pausedMarker()} {
+		if err := os.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForMigration polls an outgoing migration until it completes or fails,
+// and cancels it once migrationTimeout has passed
+func waitForMigration(mon *qmp.Client) error {
+	deadline := time.Now().Add(migrationTimeout)
+	for {
+		ret, err := mon.ExecuteTimeout("query-migrate", nil, qmpTimeout)
+		if err != nil {
+			return err
+		}
+
+		var info struct {
+			Status    string `json:"status"`
+			ErrorDesc string `json:"error-desc"`
+		}
+		if err := json.Unmarshal(ret, &info); err != nil {
+			return err
+		}
+
+		switch info.Status {
+		case "completed":
+			return nil
+		case "failed", "cancelled":
+			if info.ErrorDesc != "" {
+				return errors.New(info.ErrorDesc)
+			}
+			return errors.New("migration " + info.Status)
+		}
+
+		if time.Now().After(deadline) {
+			mon.ExecuteTimeout("migrate_cancel", nil, qmpTimeout)
+			return errors.New("timed out saving state")
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// waitForIncoming waits for an instance started with -incoming to finish
+// loading its saved state. The state was saved with the guest stopped, so it
+// comes back paused, and is continued unless it was paused when suspended.
+func (c *MachineConfig) waitForIncoming() error {
+	deadline := time.Now().Add(incomingTimeout)
+	for {
+		runState, err := c.QueryStatus()
+		if err != nil {
+			return err
+		}
+
+		switch runState {
+		case "inmigrate", "prelaunch":
+			if time.Now().After(deadline) {
+				return errors.New("timed out restoring saved state")
+			}
+			time.Sleep(250 * time.Millisecond)
+		case "paused":
+			if _, err := os.Stat(c.pausedMarker()); err == nil {
+				return nil
+			}
+			mon, err := c.QMP()
+			if err != nil {
+				return err
+			}
+			_, err = mon.ExecuteTimeout("cont", nil, qmpTimeout)
+			mon.Close()
+			if err != nil {
+				return err
+			}
+		case "running":
+			return nil
+		default:
+			return errors.New("restoring saved state left instance in state " + runState)
+		}
+	}
+}
+
+// restoredState is the state a restored instance is expected to be in
+func (c *MachineConfig) restoredState() State {
+	if _, err := os.Stat(c.pausedMarker()); err == nil {
+		return StatePaused
+	}
+	return StateRunning
+}
@@ -0,0 +1,151 @@
+package qemu
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// switchIdleTimeout is how long a network switch waits for an instance
+// before exiting
+const switchIdleTimeout = 10 * time.Second
+
+// maxFrameSize bounds the frames a switch accepts, which is well above any
+// ethernet MTU used by a guest
+const maxFrameSize = 65536
+
+// ServeSwitch forwards ethernet frames between the instances attached to the
+// network. Instances connect with QEMU stream netdevs, which send each frame
+// prefixed with its length as a 32 bit big endian integer. The switch learns
+// which instance owns each MAC address and floods frames it cannot place. It
+// returns once no instance has been connected for a while.
+func (n *Network) ServeSwitch() error {
+	socket, err := n.SwitchSocket()
+	if err != nil {
+		return err
+	}
+
+	os.Remove(socket)
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socket)
+	defer ln.Close()
+
+	var mu sync.Mutex
+	ports := make(map[net.Conn]*sync.Mutex)
+	macs := make(map[[6]byte]net.Conn)
+
+	send := func(port net.Conn, frame []byte) {
+		mu.Lock()
+		wmu, ok := ports[port]
+		mu.Unlock()
+		if !ok {
+			return
+		}
+		msg := make([]byte, 4+len(frame))
+		binary.BigEndian.PutUint32(msg, uint32(len(frame)))
+		copy(msg[4:], frame)
+
+		wmu.Lock()
+		defer wmu.Unlock()
+		// a stuck instance must not stall the others
+		port.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := port.Write(msg); err != nil {
+			// a partial write leaves the stream out of step
+			port.Close()
+		}
+	}
+
+	left := make(chan net.Conn)
+	serve := func(port net.Conn) {
+		defer func() { left <- port }()
+		r := bufio.NewReader(port)
+		for {
+			var size uint32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return
+			}
+			if size < 14 || size > maxFrameSize {
+				return
+			}
+			frame := make([]byte, size)
+			if _, err := io.ReadFull(r, frame); err != nil {
+				return
+			}
+
+			var dst, src [6]byte
+			copy(dst[:], frame[0:6])
+			copy(src[:], frame[6:12])
+
+			mu.Lock()
+			macs[src] = port
+			target, known := macs[dst]
+			var flood []net.Conn
+			if !known {
+				for p := range ports {
+					if p != port {
+						flood = append(flood, p)
+					}
+				}
+			}
+			mu.Unlock()
+
+			if known {
+				if target != port {
+					send(target, frame)
+				}
+				continue
+			}
+			for _, p := range flood {
+				send(p, frame)
+			}
+		}
+	}
+
+	joined := make(chan net.Conn)
+	go func() {
+		for {
+			port, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			joined <- port
+		}
+	}()
+
+	idle := time.NewTimer(switchIdleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case port := <-joined:
+			mu.Lock()
+			ports[port] = &sync.Mutex{}
+			mu.Unlock()
+			idle.Stop()
+			go serve(port)
+		case port := <-left:
+			port.Close()
+			mu.Lock()
+			delete(ports, port)
+			for mac, p := range macs {
+				if p == port {
+					delete(macs, mac)
+				}
+			}
+			remaining := len(ports)
+			mu.Unlock()
+			if remaining == 0 {
+				idle.Reset(switchIdleTimeout)
+			}
+		case <-idle.C:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Package qmp implements a minimal client for the QEMU Machine Protocol.
+// See https://www.qemu.org/docs/master/interop/qmp-spec.html
+package qmp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned when a command is issued on a closed connection
+var ErrClosed = errors.New("qmp: connection closed")
+
+// Error is an error response returned by QEMU
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return "qmp: " + e.Class + ": " + e.Desc
+}
+
+// Event is an asynchronous message emitted by QEMU
+type Event struct {
+	Event     string                 `json:"event"`
+	Data      map[string]interface{} `json:"data"`
+	Timestamp struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp"`
+}
+
+// Time returns the time at which QEMU emitted the event
+func (e Event) Time() time.Time {
+	return time.Unix(e.Timestamp.Seconds, e.Timestamp.Microseconds*1000)
+}
+
+type command struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+	ID        uint64      `json:"id"`
+}
+
+type message struct {
+	QMP    *json.RawMessage `json:"QMP,omitempty"`
+	Event  string           `json:"event,omitempty"`
+	Return *json.RawMessage `json:"return,omitempty"`
+	Error  *Error           `json:"error,omitempty"`
+	ID     *uint64          `json:"id,omitempty"`
+}
+
+type response struct {
+	ret json.RawMessage
+	err error
+}
+
+// Client is a QMP connection that has completed capabilities negotiation
+type Client struct {
+	conn   net.Conn
+	events chan Event
+
+	mu      sync.Mutex // serialises writes and guards the fields below
+	nextID  uint64
+	pending map[uint64]chan response
+	closed  bool
+	readErr error
+}
+
+// Dial connects to the QMP unix socket at path, reads the greeting and
+// negotiates capabilities
+func Dial(path string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn:    conn,
+		events:  make(chan Event, 64),
+		pending: make(map[uint64]chan response),
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	reader := bufio.NewReader(conn)
+	greeting, err := reader.ReadBytes('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("qmp: reading greeting: %v", err)
+	}
+	var m message
+	if err := json.Unmarshal(greeting, &m); err != nil || m.QMP == nil {
+		conn.Close()
+		return nil, errors.New("qmp: unexpected greeting from " + path)
+	}
+	conn.SetDeadline(time.Time{})
+
+	go c.read(reader)
+
+	if _, err := c.ExecuteTimeout("qmp_capabilities", nil, timeout); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Execute runs a QMP command and waits for its response. args may be nil.
+func (c *Client) Execute(cmd string, args interface{}) (json.RawMessage, error) {
+	return c.ExecuteTimeout(cmd, args, 0)
+}
+
+// ExecuteTimeout is like Execute but gives up after timeout if it is non-zero
+func (c *Client) ExecuteTimeout(cmd string, args interface{}, timeout time.Duration) (json.RawMessage, error) {
+	c.mu.Lock()
+	if c.closed {
+		err := c.readErr
+		c.mu.Unlock()
+		if err == nil {
+			err = ErrClosed
+		}
+		return nil, err
+	}
+	id := c.nextID
+	c.nextID++
+	ch := make(chan response, 1)
+	c.pending[id] = ch
+
+	payload, err := json.Marshal(command{Execute: cmd, Arguments: args, ID: id})
+	if err == nil {
+		_, err = c.conn.Write(append(payload, '\n'))
+	}
+	c.mu.Unlock()
+	if err != nil {
+		c.forget(id)
+		return nil, err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case res := <-ch:
+		return res.ret, res.err
+	case <-expired:
+		c.forget(id)
+		return nil, fmt.Errorf("qmp: timed out waiting for %s", cmd)
+	}
+}
+
+// HumanMonitorCommand runs a command in the human monitor and returns its output
+func (c *Client) HumanMonitorCommand(cmd string) (string, error) {
+	ret, err := c.Execute("human-monitor-command", map[string]string{"command-line": cmd})
+	if err != nil {
+		return "", err
+	}
+	var out string
+	if err := json.Unmarshal(ret, &out); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// Events returns the channel on which asynchronous events are delivered.
+// Events are dropped if the channel is not drained.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// WaitForEvent blocks until an event with the given name arrives or timeout expires
+func (c *Client) WaitForEvent(name string, timeout time.Duration) (Event, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case e, ok := <-c.events:
+			if !ok {
+				return Event{}, ErrClosed
+			}
+			if e.Event == name {
+				return e, nil
+			}
+		case <-timer.C:
+			return Event{}, fmt.Errorf("qmp: timed out waiting for event %s", name)
+		}
+	}
+}
+
+// Close closes the underlying connection
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.conn.Close()
+}
+
+func (c *Client) forget(id uint64) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+func (c *Client) read(reader *bufio.Reader) {
+	var err error
+	for {
+		var line []byte
+		line, err = reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+
+		var m message
+		if json.Unmarshal(line, &m) != nil {
+			continue
+		}
+
+		if m.Event != "" {
+			var e Event
+			if json.Unmarshal(line, &e) == nil {
+				select {
+				case c.events <- e:
+				default:
+				}
+			}
+			continue
+		}
+
+		if m.ID == nil {
+			continue
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[*m.ID]
+		delete(c.pending, *m.ID)
+		c.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		res := response{}
+		if m.Error != nil {
+			res.err = m.Error
+		} else if m.Return != nil {
+			res.ret = *m.Return
+		}
+		ch <- res
+	}
+
+	c.mu.Lock()
+	c.closed = true
+	c.readErr = fmt.Errorf("qmp: %v", err)
+	for id, ch := range c.pending {
+		ch <- response{err: c.readErr}
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+	close(c.events)
+}
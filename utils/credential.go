@@ -3,6 +3,7 @@ package utils
 import (
 	"fmt"
 	"os"
+	"os/exec"
 	"strings"
 )
 
@@ -11,6 +12,7 @@ type CredentialType int
 const (
 	PwdCred CredentialType = iota
 	HostCred
+	KeyCred
 )
 
 type Credential struct {
@@ -18,42 +20,117 @@ type Credential struct {
 	CR     string
 }
 
+// CredentialProvider resolves the credential strings of one backend, given
+// what follows the "<backend>::" prefix
+type CredentialProvider interface {
+	Credential(ref string) (Credential, error)
+}
+
+// CredentialProviderFunc adapts a function to a CredentialProvider
+type CredentialProviderFunc func(ref string) (Credential, error)
+
+func (f CredentialProviderFunc) Credential(ref string) (Credential, error) {
+	return f(ref)
+}
+
+// CredentialProviders maps the prefix of a credential string to its backend
+var CredentialProviders = map[string]CredentialProvider{
+	"raw":     CredentialProviderFunc(rawCredential),
+	"env":     CredentialProviderFunc(envCredential),
+	"ssh":     CredentialProviderFunc(agentCredential),
+	"key":     CredentialProviderFunc(keyCredential),
+	"file":    CredentialProviderFunc(fileCredential),
+	"cmd":     CredentialProviderFunc(commandCredential),
+	"keyring": CredentialProviderFunc(keyringCredential),
+}
+
 /*
-credential backends: raw, env, ssh-agent
-* if you want to store credentials in the macOS keychain, configure your SSH agent to use the keychain
+credential backends: raw, env, ssh-agent, key, file, cmd, keyring
 * - raw:         "raw::password" (password is a string directly after "raw::" prefix)
 * - env:         "env::PASS_VAR" (password is stored in environment variable $PASS_VAR)
 * - ssh-agent:   "ssh::HOST"     (credential is stored in ssh-agent and configured for use with host HOST in the ssh config)
+* - key:         "key::PATH"     (credential is an unencrypted private key in file PATH, relative to the instance directory)
+* - file:        "file::PATH"    (password is the content of file PATH, relative to the instance directory, which only its owner may read)
+* - cmd:         "cmd::COMMAND"  (password is what COMMAND, such as `pass show macpine/foo`, prints on stdout)
+* - keyring:     "keyring::NAME" (password is stored as account NAME of service macpine in the Secret Service or macOS keychain)
 
 * `ssh-agent` is the most secure by far, as it allows certificate-based authentication rather than using passwords.
 * If `ssh-agent` is configured and working with certificate-based authentication, `PasswordAuthentication no` can be
 * set in `/etc/ssh/sshd_config` to significantly harden the VM.
 *
+* `key` is what `launch` sets up by default: a keypair of the instance, used without an ssh-agent.
+*
+* `file`, `cmd` and `keyring` keep passwords out of config.yaml, and `cmd` defers to any password manager with a command line.
+*
 * `env` is more secure than `raw`, and may be useful for automation using macpine on systems where configuring `ssh-agent`
 * is inconvenient.
 */
 func GetCredential(config string) (Credential, error) {
-	var cred Credential
-	var err error = nil
-	if strings.HasPrefix(config, "raw::") {
-		cred.CR = strings.TrimPrefix(config, "raw::")
-		cred.CRType = PwdCred
-	} else if strings.HasPrefix(config, "env::") {
-		envvar := strings.TrimPrefix(config, "env::")
-		val, ok := os.LookupEnv(envvar)
-		if ok {
-			cred.CR = val
-			cred.CRType = PwdCred
-		} else {
-			err = fmt.Errorf("config.yaml specifies environment variable credential but variable is not set")
+	if prefix, ref, found := strings.Cut(config, "::"); found {
+		if provider, ok := CredentialProviders[prefix]; ok {
+			return provider.Credential(ref)
 		}
-	} else if strings.HasPrefix(config, "ssh::") {
-		cred.CR = strings.TrimPrefix(config, "ssh::")
-		cred.CRType = HostCred
-	} else {
-		// likely a legacy config file with a raw password and no prefix
-		cred.CR = config
-		cred.CRType = PwdCred
-	}
-	return cred, err
+	}
+	// likely a legacy config file with a raw password and no prefix
+	return Credential{CR: config, CRType: PwdCred}, nil
+}
+
+func rawCredential(ref string) (Credential, error) {
+	return Credential{CR: ref, CRType: PwdCred}, nil
+}
+
+func envCredential(ref string) (Credential, error) {
+	val, ok := os.LookupEnv(ref)
+	if !ok {
+		return Credential{}, fmt.Errorf("config.yaml specifies environment variable credential but variable is not set")
+	}
+	return Credential{CR: val, CRType: PwdCred}, nil
+}
+
+func agentCredential(ref string) (Credential, error) {
+	return Credential{CR: ref, CRType: HostCred}, nil
+}
+
+func keyCredential(ref string) (Credential, error) {
+	if ref == "" {
+		return Credential{}, fmt.Errorf("config.yaml specifies key credential but no key file")
+	}
+	return Credential{CR: ref, CRType: KeyCred}, nil
+}
+
+// fileCredential reads a password from a file, refusing files that others
+// can read as ssh does for private keys
+func fileCredential(ref string) (Credential, error) {
+	path, err := ExpandHome(ref)
+	if err != nil {
+		return Credential{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return Credential{}, fmt.Errorf("unable to read credential file: %v", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return Credential{}, fmt.Errorf("credential file %s is accessible by others (mode %04o), restrict it with chmod 600", path, info.Mode().Perm())
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return Credential{}, fmt.Errorf("unable to read credential file: %v", err)
+	}
+	return Credential{CR: strings.TrimRight(string(content), "\r\n"), CRType: PwdCred}, nil
+}
+
+// commandCredential runs a helper through the shell and takes its output,
+// without the trailing newline, as the password
+func commandCredential(ref string) (Credential, error) {
+	if ref == "" {
+		return Credential{}, fmt.Errorf("config.yaml specifies command credential but no command")
+	}
+	cmd := exec.Command("sh", "-c", ref)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return Credential{}, fmt.Errorf("credential command %q failed: %v", ref, err)
+	}
+	return Credential{CR: strings.TrimRight(string(out), "\r\n"), CRType: PwdCred}, nil
 }
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// KeyringService is the service under which keyring:: credentials are stored
+const KeyringService = "macpine"
+
+// keyringCredential looks up a password stored for account ref, through the
+// Secret Service on Linux and the login keychain on macOS
+func keyringCredential(ref string) (Credential, error) {
+	if ref == "" {
+		return Credential{}, errors.New("config.yaml specifies keyring credential but no account")
+	}
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux":
+		if !CommandExists("secret-tool") {
+			return Credential{}, errors.New("secret-tool is not available on $PATH. install libsecret to use keyring credentials")
+		}
+		cmd = exec.Command("secret-tool", "lookup", "service", KeyringService, "account", ref)
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", KeyringService, "-a", ref, "-w")
+	default:
+		return Credential{}, errors.New("keyring credentials are not supported on " + runtime.GOOS)
+	}
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return Credential{}, errors.New("unable to find " + ref + " of service " + KeyringService + " in the keyring: " + err.Error())
+	}
+	return Credential{CR: strings.TrimRight(string(out), "\r\n"), CRType: PwdCred}, nil
+}
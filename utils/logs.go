@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// RotateLog renames path to path.1, path.1 to path.2 and so on once path
+// exceeds maxSize bytes, keeping at most keep old logs
+func RotateLog(path string, maxSize int64, keep int) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() < maxSize {
+		return nil
+	}
+	return ArchiveLog(path, keep)
+}
+
+// ArchiveLog renames path to path.1, path.1 to path.2 and so on whatever its
+// size, keeping at most keep old logs
+func ArchiveLog(path string, keep int) error {
+	if err := shiftLogs(path, keep); err != nil {
+		return err
+	}
+	err := os.Rename(path, path+".1")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// TruncateLog rotates a log that a running process keeps appending to, by
+// copying it to path.1 and truncating it in place once it exceeds maxSize
+// bytes. Lines written while it is copied may be lost.
+func TruncateLog(path string, maxSize int64, keep int) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() < maxSize {
+		return nil
+	}
+
+	if err := shiftLogs(path, keep); err != nil {
+		return err
+	}
+	if _, err := CopyFile(path, path+".1"); err != nil {
+		return err
+	}
+	return os.Truncate(path, 0)
+}
+
+// shiftLogs renames path.1 to path.2 and so on, dropping path.keep
+func shiftLogs(path string, keep int) error {
+	os.Remove(path + "." + strconv.Itoa(keep))
+	for i := keep - 1; i > 0; i-- {
+		err := os.Rename(path+"."+strconv.Itoa(i), path+"."+strconv.Itoa(i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadLines returns the lines of a file and its size in bytes
+func ReadLines(path string) ([]string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var lines []string
+	var size int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		size += int64(len(line))
+		if line != "" {
+			lines = append(lines, line)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return lines, size, nil
+}
+
+// FollowFile writes everything appended to path after offset to w, polling
+// until stop is closed. If the file is truncated or replaced, for example by
+// RotateLog, it is read again from the start.
+func FollowFile(path string, offset int64, w io.Writer, stop <-chan struct{}) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { file.Close() }()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	for {
+		n, err := io.Copy(w, file)
+		if err != nil {
+			return err
+		}
+		offset += n
+
+		if n == 0 {
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(500 * time.Millisecond):
+			}
+
+			current, statErr := os.Stat(path)
+			opened, _ := file.Stat()
+			if statErr == nil && (!os.SameFile(current, opened) || current.Size() < offset) {
+				reopened, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				file.Close()
+				file = reopened
+				offset = 0
+			}
+		}
+	}
+}
+
+// TimestampWriter prefixes every line written through it with the current
+// time in RFC 3339 format
+type TimestampWriter struct {
+	W       io.Writer
+	midLine bool
+}
+
+func (t *TimestampWriter) Write(p []byte) (int, error) {
+	var out []byte
+	for _, b := range p {
+		if !t.midLine {
+			out = append(out, time.Now().UTC().Format(time.RFC3339)+" "...)
+			t.midLine = true
+		}
+		out = append(out, b)
+		if b == '\n' {
+			t.midLine = false
+		}
+	}
+	if _, err := t.W.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
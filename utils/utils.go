@@ -3,8 +3,10 @@ package utils
 import (
 	"archive/tar"
 	"compress/gzip"
+	"crypto/sha256"
 	"embed"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -69,13 +71,90 @@ const (
 	Udp
 )
 
+func (p Protocol) String() string {
+	if p == Udp {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// PortMap forwards Count consecutive host ports, starting at Host, to the
+// guest ports starting at Guest
 type PortMap struct {
-	Host  int
-	Guest int
-	Proto Protocol
+	Address string // host address to bind, all interfaces if empty
+	Host    int
+	Guest   int
+	Count   int
+	Proto   Protocol
+	Auto    bool // host ports are still to be allocated
+}
+
+// HostPorts formats the host port or range of ports, such as 8000-8010
+func (p PortMap) HostPorts() string {
+	if p.Auto {
+		return "auto"
+	}
+	return portRange(p.Host, p.Count)
+}
+
+// GuestPorts formats the guest port or range of ports, such as 9000-9010
+func (p PortMap) GuestPorts() string {
+	return portRange(p.Guest, p.Count)
+}
+
+// String formats a port mapping in the syntax accepted by ParsePort
+func (p PortMap) String() string {
+	s := p.HostPorts()
+	if p.Auto || p.Guest != p.Host {
+		s += ":" + p.GuestPorts()
+	}
+	if p.Address != "" {
+		if strings.Contains(p.Address, ":") {
+			s = "[" + p.Address + "]:" + s
+		} else {
+			s = p.Address + ":" + s
+		}
+	}
+	if p.Proto == Udp {
+		s += "u"
+	}
+	return s
+}
+
+// Expand splits a port range into single port mappings
+func (p PortMap) Expand() []PortMap {
+	maps := make([]PortMap, p.Count)
+	for i := range maps {
+		maps[i] = PortMap{Address: p.Address, Host: p.Host + i, Guest: p.Guest + i, Count: 1, Proto: p.Proto}
+	}
+	return maps
+}
+
+// Overlaps reports whether p and q forward any of the same host ports on the
+// same address. An empty address overlaps every address.
+func (p PortMap) Overlaps(q PortMap) bool {
+	if p.Proto != q.Proto {
+		return false
+	}
+	if p.Address != "" && q.Address != "" && p.Address != q.Address {
+		return false
+	}
+	return p.Host < q.Host+q.Count && q.Host < p.Host+p.Count
+}
+
+// FormatPorts formats port mappings as a config.yaml port string
+func FormatPorts(maps []PortMap) string {
+	ports := make([]string, len(maps))
+	for i, p := range maps {
+		ports[i] = p.String()
+	}
+	return strings.Join(ports, ",")
 }
 
-// Parses port mapping configurations
+// Parses port mapping configurations of the form
+// [address:]host[-host][:guest[-guest]][u], for example 8080, 8080:80,
+// 127.0.0.1:8080:80, [::1]:8080:80 or 8000-8010:9000-9010u. A host part of
+// auto, as in auto:80, leaves the host ports to be allocated.
 func ParsePort(ports string) ([]PortMap, error) {
 	var maps []PortMap = nil
 	if ports == "" {
@@ -87,27 +166,58 @@ func ParsePort(ports string) ([]PortMap, error) {
 	}
 	maps = make([]PortMap, mapcount)
 	for i, p := range strings.Split(ports, ",") {
-		newmap := PortMap{0, 0, Tcp}
-		var herr, gerr error
+		newmap := PortMap{Proto: Tcp}
 		if strings.HasSuffix(p, "u") {
 			newmap.Proto = Udp
 			p = strings.TrimSuffix(p, "u")
 		}
-		if strings.Contains(p, ":") {
-			pair := strings.Split(p, ":")
-			if len(pair) != 2 {
-				return nil, errors.New("incorrect port mapping pair specified. Check config.yaml")
+
+		var parts []string
+		if strings.HasPrefix(p, "[") {
+			end := strings.Index(p, "]:")
+			if end < 0 {
+				return nil, errors.New("incorrect bind address in port mapping " + p + ". Check config.yaml")
 			}
-			newmap.Host, herr = strconv.Atoi(pair[0])
-			newmap.Guest, gerr = strconv.Atoi(pair[1])
+			newmap.Address = p[1:end]
+			parts = strings.Split(p[end+2:], ":")
 		} else {
-			newmap.Host, herr = strconv.Atoi(p)
-			newmap.Guest = newmap.Host
+			parts = strings.Split(p, ":")
+			if len(parts) == 3 || (len(parts) == 2 && net.ParseIP(parts[0]) != nil) {
+				newmap.Address = parts[0]
+				parts = parts[1:]
+			}
+		}
+		if newmap.Address != "" && net.ParseIP(newmap.Address) == nil {
+			return nil, errors.New("invalid bind address " + newmap.Address + ". Check config.yaml")
+		}
+		if len(parts) > 2 {
+			return nil, errors.New("incorrect port mapping pair specified. Check config.yaml")
+		}
+
+		var guestCount int
+		var herr, gerr error
+		if parts[0] == "auto" {
+			if len(parts) != 2 {
+				return nil, errors.New("auto port mapping needs a guest port, such as auto:80. Check config.yaml")
+			}
+			newmap.Auto = true
+			newmap.Guest, newmap.Count, gerr = ParsePortRange(parts[1])
+			guestCount = newmap.Count
+		} else {
+			newmap.Host, newmap.Count, herr = ParsePortRange(parts[0])
+			if len(parts) == 2 {
+				newmap.Guest, guestCount, gerr = ParsePortRange(parts[1])
+			} else {
+				newmap.Guest, guestCount = newmap.Host, newmap.Count
+			}
 		}
 		if herr != nil || gerr != nil {
 			return nil, errors.New("error parsing specified ports. Check config.yaml")
 		}
-		if newmap.Host < 0 || newmap.Host > 65535 || newmap.Guest < 0 || newmap.Guest > 65535 {
+		if newmap.Count != guestCount {
+			return nil, errors.New("host and guest port ranges differ in length. Check config.yaml")
+		}
+		if newmap.Host < 0 || newmap.Host+newmap.Count-1 > 65535 || newmap.Guest < 0 || newmap.Guest+newmap.Count-1 > 65535 {
 			return nil, errors.New("invalid specified ports (must be 0-65535). Check config.yaml")
 		}
 		maps[i] = newmap
@@ -115,9 +225,35 @@ func ParsePort(ports string) ([]PortMap, error) {
 	return maps, nil
 }
 
+// ParsePortRange parses a port or a range of ports such as 8000-8010 into its
+// first port and the number of ports
+func ParsePortRange(ports string) (int, int, error) {
+	first, last, isRange := strings.Cut(ports, "-")
+	start, err := strconv.Atoi(first)
+	if err != nil || !isRange {
+		return start, 1, err
+	}
+	end, err := strconv.Atoi(last)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end < start {
+		return 0, 0, errors.New("invalid port range " + ports)
+	}
+	return start, end - start + 1, nil
+}
+
+// portRange formats count ports starting at start, as parsed by ParsePortRange
+func portRange(start int, count int) string {
+	if count <= 1 {
+		return strconv.Itoa(start)
+	}
+	return strconv.Itoa(start) + "-" + strconv.Itoa(start+count-1)
+}
+
 // Ping checks if connection is reachable
 func Ping(ip string, port string) error {
-	address, err := net.ResolveTCPAddr("tcp", ip+":"+port)
+	address, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ip, port))
 	if err != nil {
 		return err
 	}
@@ -265,6 +401,59 @@ func CopyFile(src, dst string) (int64, error) {
 	return nBytes, err
 }
 
+// FileSHA256 returns the hex encoded SHA-256 digest of a file
+func FileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// WriteFileAtomic writes data to a temporary file next to path and renames it
+// into place, so that readers never see a partially written file
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ExpandHome replaces a leading ~/ in path with the home directory
+func ExpandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, path[2:]), nil
+}
+
 type WriteCounter struct {
 	Total uint64
 }
@@ -470,25 +659,70 @@ func ConvertStringArrayToDhcpDataArray(dataArray [][]string) []DhcpData {
 	var data []DhcpData
 
 	for _, entry := range dataArray {
+		// skip malformed lease blocks
+		if len(entry) != 5 {
+			continue
+		}
 		hwAddressParts := strings.SplitN(entry[2], ",", 2)
-		hAddress := hwAddressParts[1]
-		if len(entry) == 5 {
-			dataItem := DhcpData{
-				Name:       entry[0],
-				IpAddress:  entry[1],
-				HwAddress:  hAddress,
-				Identifier: entry[3],
-				Lease:      entry[4],
-			}
-			data = append(data, dataItem)
+		if len(hwAddressParts) != 2 {
+			continue
+		}
+		dataItem := DhcpData{
+			Name:       entry[0],
+			IpAddress:  entry[1],
+			HwAddress:  hwAddressParts[1],
+			Identifier: entry[3],
+			Lease:      entry[4],
 		}
+		data = append(data, dataItem)
 	}
 	return data
 }
 
+// ParseDnsmasqLeasesFile parses a dnsmasq lease file, which has one lease per
+// line: expiry time, MAC address, IP address, hostname and client id
+func ParseDnsmasqLeasesFile(input string) []DhcpData {
+	var data []DhcpData
+	for _, line := range strings.Split(input, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		dataItem := DhcpData{
+			Lease:     fields[0],
+			HwAddress: strings.ToLower(fields[1]),
+			IpAddress: fields[2],
+			Name:      fields[3],
+		}
+		if len(fields) > 4 {
+			dataItem.Identifier = fields[4]
+		}
+		data = append(data, dataItem)
+	}
+	return data
+}
+
+// NormalizeMAC formats a MAC address as six lower case, zero padded octets.
+// bootpd and the macOS arp command drop leading zeros, as in 56:ab:1:2:3:4.
+// Addresses that do not parse are returned lower cased.
+func NormalizeMAC(mac string) string {
+	octets := strings.Split(strings.ToLower(mac), ":")
+	if len(octets) != 6 {
+		return strings.ToLower(mac)
+	}
+	for i, o := range octets {
+		n, err := strconv.ParseUint(o, 16, 8)
+		if err != nil {
+			return strings.ToLower(mac)
+		}
+		octets[i] = fmt.Sprintf("%02x", n)
+	}
+	return strings.Join(octets, ":")
+}
+
 func MatchHwAddress(data []DhcpData, targetHwAddress string) *DhcpData {
 	for i := range data {
-		if data[i].HwAddress == targetHwAddress {
+		if NormalizeMAC(data[i].HwAddress) == NormalizeMAC(targetHwAddress) {
 			return &data[i]
 		}
 	}